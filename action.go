@@ -0,0 +1,238 @@
+package lazy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+var typeOfURLValues = reflect.TypeOf(url.Values{})
+
+// typeOfNoResult is the type codecs are selected for when an action has no
+// result.
+var typeOfNoResult = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// Actor is implemented by services that declare their actions explicitly.
+// Actions returns the names of the methods to expose as actions.  Services
+// that don't implement Actor expose every method with an action signature
+// besides the CRUD methods.
+//
+// Actions are operations beyond the CRUD operations, with one of the
+// signatures
+//
+//	func (s *Service) Name(ctx context.Context, id int, in In) (Out, error)
+//	func (s *Service) Name(ctx context.Context, in In) (Out, error)
+//
+// where id selects a record, in and Out are optional, and In is a pointer to
+// a struct decoded from the request body or url.Values holding the query
+// arguments.  Record actions are served at POST /prefix/{id}/:name and
+// collection actions at POST /prefix/:name, where name is the method name
+// with its first letter lowered.  Actions are only served over REST.
+type Actor interface {
+	Actions() []string
+}
+
+// crudMethods are the methods never exposed as actions.
+var crudMethods = map[string]bool{
+	"Get": true, "Put": true, "New": true, "Delete": true, "Query": true,
+	"GetMulti": true, "Actions": true,
+}
+
+// action is a custom action of a service, as described by Actor.
+type action struct {
+	name   string
+	method reflect.Method
+	record bool
+	in     reflect.Type
+	out    reflect.Type
+}
+
+func actionName(method string) string {
+	r, n := utf8.DecodeRuneInString(method)
+	return string(unicode.ToLower(r)) + method[n:]
+}
+
+// newAction validates the signature of method as an action.
+func newAction(method reflect.Method) (*action, error) {
+	a := &action{name: actionName(method.Name), method: method}
+	t := method.Type
+
+	if t.NumIn() < 2 || t.In(1) != typeOfContext {
+		return nil, fmt.Errorf("Action %s must take a context.Context first", method.Name)
+	}
+	i := 2
+	if i < t.NumIn() && t.In(i).Kind() == reflect.Int {
+		a.record = true
+		i++
+	}
+	if i < t.NumIn() {
+		a.in = t.In(i)
+		isStruct := a.in.Kind() == reflect.Ptr && a.in.Elem().Kind() == reflect.Struct
+		if a.in != typeOfURLValues && !isStruct {
+			return nil, fmt.Errorf("Input of action %s must be a struct pointer or url.Values.  Found %v instead",
+				method.Name, a.in)
+		}
+		if !isExportedOrBuiltinType(a.in) {
+			return nil, fmt.Errorf("Input type %v of action %s not exported", a.in, method.Name)
+		}
+		i++
+	}
+	if i != t.NumIn() {
+		return nil, fmt.Errorf("Action %s has too many arguments", method.Name)
+	}
+
+	if t.NumOut() < 1 || t.NumOut() > 2 || t.Out(t.NumOut()-1) != typeOfError {
+		return nil, fmt.Errorf("Action %s must return an optional result and an error", method.Name)
+	}
+	if t.NumOut() == 2 {
+		a.out = t.Out(0)
+		if !isExportedOrBuiltinType(a.out) {
+			return nil, fmt.Errorf("Result type %v of action %s not exported", a.out, method.Name)
+		}
+	}
+	return a, nil
+}
+
+// findActions finds the service's actions: the methods it lists if it is an
+// Actor, otherwise every exported method with an action signature.
+func (e *endpoint) findActions() error {
+	e.actions = make(map[string]*action)
+
+	if actor, ok := e.actor(); ok {
+		for _, name := range actor.Actions() {
+			method, ok := e.serviceType.MethodByName(name)
+			if !ok || crudMethods[name] {
+				return fmt.Errorf("Service does not have an action method %s", name)
+			}
+			a, err := newAction(method)
+			if err != nil {
+				return err
+			}
+			e.actions[a.name] = a
+		}
+		return nil
+	}
+
+	for i := 0; i < e.serviceType.NumMethod(); i++ {
+		method := e.serviceType.Method(i)
+		if crudMethods[method.Name] {
+			continue
+		}
+		if a, err := newAction(method); err == nil {
+			e.actions[a.name] = a
+		}
+	}
+	return nil
+}
+
+// actor returns the service as an Actor, if it is one.  Services added as
+// factories have no instance to ask, so Actions is called on the zero value
+// of their type.
+func (e *endpoint) actor() (Actor, bool) {
+	if e.service != nil {
+		actor, ok := e.service.(Actor)
+		return actor, ok
+	}
+	actor, ok := reflect.Zero(e.serviceType).Interface().(Actor)
+	return actor, ok
+}
+
+// sortedActions lists the service's actions ordered by name.
+func (e *endpoint) sortedActions() []*action {
+	var actions []*action
+	for _, a := range e.actions {
+		actions = append(actions, a)
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i].name < actions[j].name })
+	return actions
+}
+
+// handleAction returns the handler of action a.
+func (e *endpoint) handleAction(a *action) http.HandlerFunc {
+	resultType := a.out
+	if resultType == nil {
+		resultType = typeOfNoResult
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			e.sendError(w, r, http.StatusMethodNotAllowed, "Actions require POST")
+			return
+		}
+
+		codec := e.codecs.responseCodec(r, resultType)
+		if codec == nil {
+			http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+			return
+		}
+
+		var args []reflect.Value
+		id := 0
+		if a.record {
+			var err error
+			id, err = strconv.Atoi(mux.Vars(r)["id"])
+			if err != nil {
+				http.Error(w, "Invalid ID", http.StatusBadRequest)
+				return
+			}
+			args = append(args, reflect.ValueOf(id))
+		}
+		if a.in == typeOfURLValues {
+			args = append(args, reflect.ValueOf(r.URL.Query()))
+		} else if a.in != nil {
+			in, err := e.decode(r, a.in)
+			if err != nil {
+				handleDecodeError(r, err, w)
+				return
+			}
+			args = append(args, *in)
+		}
+
+		ctx, cancel := e.operationContext(r.Context(), Operation(a.name))
+		defer cancel()
+		var values []reflect.Value
+		err := e.transact(ctx, func(ctx context.Context) error {
+			values = e.call(ctx, a.method, args...)
+			err := callError(values[len(values)-1])
+			if err == nil {
+				// Actions may change the records they act on and any
+				// query result.
+				if a.record {
+					e.invalidate(ctx, id)
+				} else {
+					e.invalidate(ctx)
+				}
+			}
+			return err
+		})
+		if e.handleCallError(r, a.method.Name, err, w) {
+			return
+		}
+
+		var result interface{}
+		if a.out != nil {
+			result = values[0].Interface()
+		}
+		e.sendResponse(w, r, codec, result)
+	}
+}
+
+// addActionRoutes adds the routes of the service's actions.
+func (e *endpoint) addActionRoutes() {
+	for _, a := range e.sortedActions() {
+		path := "/:" + a.name
+		if a.record {
+			path = "/{id:[0-9]+}" + path
+		}
+		e.handle(path, e.serve(Operation(a.name), e.handleAction(a)))
+	}
+}
@@ -0,0 +1,152 @@
+package lazy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+type ActionTestRename struct {
+	Name string `json:"name"`
+}
+
+type ActionTestStats struct {
+	Count int    `json:"count"`
+	Tag   string `json:"tag"`
+}
+
+type ActionTestService struct {
+	TestService
+	Published []int
+}
+
+func (s *ActionTestService) Publish(ctx context.Context, id int) error {
+	if _, ok := s.data[id]; !ok {
+		return fmt.Errorf("ID %d does not exist", id)
+	}
+	s.Published = append(s.Published, id)
+	return nil
+}
+
+func (s *ActionTestService) Rename(ctx context.Context, id int, in *ActionTestRename) (*TestData, error) {
+	data, ok := s.data[id]
+	if !ok {
+		return nil, fmt.Errorf("ID %d does not exist", id)
+	}
+	data.Name = in.Name
+	return data, nil
+}
+
+func (s *ActionTestService) Stats(ctx context.Context, args url.Values) (*ActionTestStats, error) {
+	return &ActionTestStats{Count: len(s.data), Tag: args.Get("tag")}, nil
+}
+
+// Helper does not have an action signature.
+func (s *ActionTestService) Helper(id int) int {
+	return id
+}
+
+type DeclaredActionTestService struct {
+	ActionTestService
+}
+
+func (s *DeclaredActionTestService) Actions() []string {
+	return []string{"Publish"}
+}
+
+type BadActionTestService struct {
+	TestService
+}
+
+func (s *BadActionTestService) Actions() []string {
+	return []string{"Helper"}
+}
+
+func (s *BadActionTestService) Helper(id int) int {
+	return id
+}
+
+func testActionReq(t *testing.T, method string, url string, body string, data interface{}) int {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s error: %v", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && data != nil {
+		ret := Response{Data: data}
+		err = json.NewDecoder(resp.Body).Decode(&ret)
+		if err != nil {
+			t.Fatalf("Can't decode %s response: %v", url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestActions(t *testing.T) {
+	r := NewRouter()
+	s := &ActionTestService{TestService: *NewTestService()}
+	err := r.AddService("test", s)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	declared := &DeclaredActionTestService{ActionTestService{TestService: *NewTestService()}}
+	err = r.AddService("declared", declared)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	err = NewRouter().AddService("bad", &BadActionTestService{TestService: *NewTestService()})
+	if err == nil {
+		t.Errorf("Expected error adding service declaring a bad action")
+	}
+	addr := startTestServer(t, r)
+	base := fmt.Sprintf("http://%s/test", addr)
+
+	testAndValidateNewReq(t, addr, &TestData{ID: 1, Name: "Test 1"})
+
+	if status := testActionReq(t, "POST", base+"/1/:publish", "", nil); status != http.StatusOK {
+		t.Errorf("Expected publish to succeed, got %d", status)
+	}
+	if len(s.Published) != 1 || s.Published[0] != 1 {
+		t.Errorf("Expected record 1 to be published, got %v", s.Published)
+	}
+	if status := testActionReq(t, "POST", base+"/2/:publish", "", nil); status != http.StatusInternalServerError {
+		t.Errorf("Expected publish of missing record to fail, got %d", status)
+	}
+	if status := testActionReq(t, "GET", base+"/1/:publish", "", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected actions to require POST, got %d", status)
+	}
+
+	var data TestData
+	status := testActionReq(t, "POST", base+"/1/:rename", `{"name": "Renamed"}`, &data)
+	if status != http.StatusOK || data.Name != "Renamed" {
+		t.Errorf("Expected rename to return renamed record, got %d %+v", status, data)
+	}
+	testAndValidateGetReq(t, addr, 1, "Renamed")
+
+	var stats ActionTestStats
+	status = testActionReq(t, "POST", base+"/:stats?tag=x", "", &stats)
+	if status != http.StatusOK || stats.Count != 1 || stats.Tag != "x" {
+		t.Errorf("Unexpected stats %d %+v", status, stats)
+	}
+
+	if status := testActionReq(t, "POST", base+"/1/:helper", "", nil); status != http.StatusNotFound {
+		t.Errorf("Expected helper not to be an action, got %d", status)
+	}
+
+	// Only declared actions are exposed.
+	declaredBase := fmt.Sprintf("http://%s/declared", addr)
+	if status := testActionReq(t, "POST", declaredBase+"/:stats", "", nil); status != http.StatusNotFound {
+		t.Errorf("Expected undeclared action to be missing, got %d", status)
+	}
+
+	info := r.Services()[1]
+	if len(info.Actions) != 3 || info.Actions[0].Name != "publish" || !info.Actions[0].Record ||
+		info.Actions[1].Output == nil || info.Actions[2].Record {
+		t.Errorf("Unexpected actions %+v", info.Actions)
+	}
+}
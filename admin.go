@@ -0,0 +1,134 @@
+package lazy
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+//go:embed admin
+var adminFS embed.FS
+
+var adminTemplates = template.Must(template.ParseFS(adminFS, "admin/*.html"))
+
+// adminPage holds the data rendered by the admin templates.
+type adminPage struct {
+	Title    string
+	Services []ServiceInfo
+	Service  *ServiceInfo
+
+	// Admin and Static are the relative URLs of the admin index and its
+	// static assets.  API is the relative URL of the service's REST routes.
+	// Relative URLs keep the UI working when the Router is mounted below
+	// another path.
+	Admin  string
+	Static string
+	API    string
+
+	// IDField names the data field holding record ids, if any.
+	IDField string
+}
+
+type adminHandler struct {
+	router *Router
+	path   string
+	static http.Handler
+}
+
+func newAdminHandler(r *Router, path string) *adminHandler {
+	static, err := fs.Sub(adminFS, "admin")
+	if err != nil {
+		panic(err)
+	}
+	return &adminHandler{
+		router: r,
+		path:   strings.TrimSuffix(path, "/"),
+		static: http.FileServer(http.FS(static)),
+	}
+}
+
+func (h *adminHandler) render(w http.ResponseWriter, name string, page *adminPage) {
+	var buf bytes.Buffer
+	err := adminTemplates.ExecuteTemplate(&buf, name, page)
+	if err != nil {
+		h.router.baseLogger().Error("Admin template error", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rest := strings.TrimPrefix(req.URL.Path, h.path+"/")
+
+	if strings.HasPrefix(rest, "static/") {
+		// Templates are not assets.
+		if strings.HasSuffix(rest, ".html") {
+			http.NotFound(w, req)
+			return
+		}
+		req.URL.Path = strings.TrimPrefix(rest, "static")
+		h.static.ServeHTTP(w, req)
+		return
+	}
+
+	// The number of directories between the requested page and the root of
+	// the router.
+	depth := strings.Count(strings.Trim(h.path, "/"), "/") + strings.Count(rest, "/") + 1
+	root := strings.Repeat("../", depth)
+	page := &adminPage{
+		Title:  "Services",
+		Admin:  root + strings.Trim(h.path, "/") + "/",
+		Static: root + strings.Trim(h.path, "/") + "/static/",
+	}
+
+	if rest == "" {
+		// Child services have no routes of their own to browse.
+		for _, info := range h.router.Services() {
+			if info.Parent == "" {
+				page.Services = append(page.Services, info)
+			}
+		}
+		h.render(w, "index.html", page)
+		return
+	}
+
+	e, ok := h.router.endpoint(rest)
+	if !ok || e.parent != nil {
+		http.NotFound(w, req)
+		return
+	}
+	info := e.info()
+	page.Title = info.Prefix
+	page.Service = &info
+	page.API = root + info.Prefix + "/"
+	for _, f := range info.DataType.Fields {
+		if strings.EqualFold(f.Name, "id") {
+			page.IDField = f.Name
+			break
+		}
+	}
+	h.render(w, "service.html", page)
+}
+
+// WithAdmin serves a web UI for browsing and editing the records of every
+// service below adminPath, e.g. "/_lazy/admin".  Forms are derived from the
+// services' data types and all changes are made through the services' REST
+// routes.
+func WithAdmin(adminPath string) RouterOption {
+	return func(r *Router) {
+		h := newAdminHandler(r, adminPath)
+		r.router.HandleFunc(h.path, func(w http.ResponseWriter, req *http.Request) {
+			// Redirect relatively to stay below any path the router is
+			// mounted at.
+			w.Header().Set("Location", path.Base(h.path)+"/")
+			w.WriteHeader(http.StatusMovedPermanently)
+		})
+		r.router.PathPrefix(h.path + "/").Handler(h)
+	}
+}
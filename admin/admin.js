@@ -0,0 +1,202 @@
+// Admin UI for a single lazy service.  All data is read and written through
+// the service's REST routes.
+(function() {
+  'use strict';
+
+  var root = document.getElementById('service');
+  var api = root.dataset.api;
+  var idField = root.dataset.idField;
+  var errorEl = document.getElementById('error');
+  var sections = ['list', 'detail', 'edit'];
+
+  function show(name) {
+    sections.forEach(function(s) {
+      document.getElementById(s).hidden = s !== name;
+    });
+  }
+
+  function showError(err) {
+    errorEl.textContent = String(err);
+    errorEl.hidden = false;
+  }
+
+  function request(path, body) {
+    var opts = {headers: {'Accept': 'application/json'}};
+    if (body !== undefined) {
+      opts.method = 'POST';
+      opts.headers['Content-Type'] = 'application/json';
+      opts.body = JSON.stringify(body);
+    }
+    return fetch(api + path, opts).then(function(resp) {
+      if (!resp.ok) {
+        return resp.text().then(function(text) {
+          throw new Error(resp.status + ': ' + text);
+        });
+      }
+      return resp.json();
+    }).then(function(ret) {
+      if (ret.error) {
+        throw new Error(ret.error);
+      }
+      return ret.data;
+    });
+  }
+
+  function display(value) {
+    if (value === null || value === undefined) {
+      return '';
+    }
+    if (typeof value === 'object') {
+      return JSON.stringify(value);
+    }
+    return String(value);
+  }
+
+  function renderList(records) {
+    var tbody = document.querySelector('#list tbody');
+    var fields = Array.prototype.map.call(
+        document.querySelectorAll('#list thead th'),
+        function(th) { return th.textContent; });
+    tbody.textContent = '';
+    (records || []).forEach(function(record) {
+      var tr = document.createElement('tr');
+      fields.forEach(function(field) {
+        var td = document.createElement('td');
+        var text = display(record[field]);
+        if (field === idField) {
+          var a = document.createElement('a');
+          a.href = '#view/' + encodeURIComponent(text);
+          a.textContent = text;
+          td.appendChild(a);
+        } else {
+          td.textContent = text;
+        }
+        tr.appendChild(td);
+      });
+      tbody.appendChild(tr);
+    });
+  }
+
+  function list() {
+    var args = document.querySelector('#filter input[name=args]').value;
+    request('query' + (args ? '?' + args : '')).then(function(records) {
+      renderList(records);
+      show('list');
+    }, showError);
+  }
+
+  function view(id) {
+    request('get/' + id).then(function(record) {
+      document.querySelectorAll('#detail [data-field]').forEach(function(dd) {
+        dd.textContent = display(record[dd.dataset.field]);
+      });
+      document.getElementById('edit-link').href = '#edit/' + id;
+      document.getElementById('delete').onclick = function() {
+        if (!window.confirm('Delete ' + id + '?')) {
+          return;
+        }
+        request('delete/' + id).then(function() {
+          location.hash = '';
+        }, showError);
+      };
+      show('detail');
+    }, showError);
+  }
+
+  function fillForm(record) {
+    document.querySelectorAll('#record [data-kind]').forEach(function(input) {
+      var value = record[input.name];
+      switch (input.dataset.kind) {
+      case 'boolean':
+        input.checked = !!value;
+        break;
+      case 'json':
+        input.value = value === undefined ? '' : JSON.stringify(value, null, 2);
+        break;
+      default:
+        input.value = display(value);
+      }
+    });
+  }
+
+  function readForm() {
+    var record = {};
+    document.querySelectorAll('#record [data-kind]').forEach(function(input) {
+      switch (input.dataset.kind) {
+      case 'boolean':
+        record[input.name] = input.checked;
+        break;
+      case 'integer':
+      case 'number':
+        if (input.value !== '') {
+          record[input.name] = Number(input.value);
+        }
+        break;
+      case 'json':
+        if (input.value !== '') {
+          record[input.name] = JSON.parse(input.value);
+        }
+        break;
+      default:
+        record[input.name] = input.value;
+      }
+    });
+    return record;
+  }
+
+  function edit(id) {
+    var form = document.getElementById('record');
+    var title = document.querySelector('#edit h2');
+    form.onsubmit = function(ev) {
+      ev.preventDefault();
+      var record;
+      try {
+        record = readForm();
+      } catch (err) {
+        showError(err);
+        return;
+      }
+      var path = id === undefined ? 'new' : 'put/' + id;
+      request(path, record).then(function(newID) {
+        location.hash = '#view/' + newID;
+      }, showError);
+    };
+
+    if (id === undefined) {
+      title.textContent = 'New';
+      fillForm({});
+      show('edit');
+      return;
+    }
+    title.textContent = 'Edit ' + id;
+    request('get/' + id).then(function(record) {
+      fillForm(record);
+      show('edit');
+    }, showError);
+  }
+
+  function route() {
+    errorEl.hidden = true;
+    var parts = location.hash.replace(/^#/, '').split('/');
+    switch (parts[0]) {
+    case 'new':
+      edit();
+      break;
+    case 'view':
+      view(parts[1]);
+      break;
+    case 'edit':
+      edit(parts[1]);
+      break;
+    default:
+      list();
+    }
+  }
+
+  document.getElementById('filter').onsubmit = function(ev) {
+    ev.preventDefault();
+    list();
+  };
+  window.addEventListener('hashchange', route);
+  route();
+})();
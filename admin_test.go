@@ -0,0 +1,74 @@
+package lazy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func testAdminGet(t *testing.T, addr string, uri string) (int, string) {
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", addr, uri))
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Can't read response body: %v", err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func testAndValidateAdminGet(t *testing.T, addr string, uri string, contents ...string) {
+	status, body := testAdminGet(t, addr, uri)
+	if status != http.StatusOK {
+		t.Errorf("Expected %d from %s, got %d", http.StatusOK, uri, status)
+		return
+	}
+	for _, c := range contents {
+		if !strings.Contains(body, c) {
+			t.Errorf("Expected %s to contain %q:\n%s", uri, c, body)
+		}
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	r := NewRouter(WithAdmin("/_lazy/admin"))
+	err := r.AddService("test", NewTestService())
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	err = r.AddService("nested/test", NewTestService())
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	testAndValidateAdminGet(t, addr, "/_lazy/admin",
+		`href="../../_lazy/admin/test"`,
+		`href="../../_lazy/admin/nested/test"`,
+		`<td>lazy.TestData</td>`,
+		`href="../../_lazy/admin/static/admin.css"`)
+
+	testAndValidateAdminGet(t, addr, "/_lazy/admin/test",
+		`data-api="../../test/"`,
+		`data-id-field="ID"`,
+		`<input type="number" step="1" name="ID" data-kind="integer">`,
+		`<input type="text" name="Name" data-kind="string">`,
+		`src="../../_lazy/admin/static/admin.js"`)
+
+	testAndValidateAdminGet(t, addr, "/_lazy/admin/nested/test",
+		`data-api="../../../nested/test/"`,
+		`src="../../../_lazy/admin/static/admin.js"`)
+
+	testAndValidateAdminGet(t, addr, "/_lazy/admin/static/admin.js", "request('query'")
+
+	for _, uri := range []string{"/_lazy/admin/bogus", "/_lazy/admin/static/service.html"} {
+		status, _ := testAdminGet(t, addr, uri)
+		if status != http.StatusNotFound {
+			t.Errorf("Expected %d from %s, got %d", http.StatusNotFound, uri, status)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package lazy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OpAudit is the operation of services with an audit log that lists their
+// audit events.
+const OpAudit Operation = "audit"
+
+var typeOfAuditEvents = reflect.TypeOf([]AuditEvent(nil))
+
+type principalKey struct{}
+
+// ContextWithPrincipal returns a copy of ctx carrying the principal making
+// the request, e.g. set by authentication middleware.
+func ContextWithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal in ctx, or "".
+func PrincipalFromContext(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}
+
+// AuditEvent records a successful change to a record.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Principal string    `json:"principal,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+	Prefix    string    `json:"prefix"`
+	Operation Operation `json:"operation"`
+	ID        int       `json:"id"`
+
+	// Parents are the ids of the parent records of a record of a child
+	// service, by the prefixes of the parent services.
+	Parents map[string]int `json:"parents,omitempty"`
+
+	// Before and After are the JSON encodings of the record before and
+	// after the change.  Before is empty for New, and After for Delete.
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+
+	// Changed lists the fields whose values differ between Before and
+	// After, in sorted order.
+	Changed []string `json:"changed,omitempty"`
+}
+
+// AuditFilter selects audit events.  Zero fields match every event.
+type AuditFilter struct {
+	Tenant    string
+	Prefix    string
+	ID        *int
+	Principal string
+	Since     time.Time
+	Until     time.Time
+
+	// Parents selects the events of records below the parent records with
+	// these ids, by the prefixes of the parent services.
+	Parents map[string]int
+
+	// Limit is the maximum number of events returned.  The most recent
+	// events are kept.
+	Limit int
+}
+
+func (f *AuditFilter) matches(ev *AuditEvent) bool {
+	for prefix, id := range f.Parents {
+		if parent, ok := ev.Parents[prefix]; !ok || parent != id {
+			return false
+		}
+	}
+	return (f.Tenant == "" || ev.Tenant == f.Tenant) &&
+		(f.Prefix == "" || ev.Prefix == f.Prefix) &&
+		(f.ID == nil || ev.ID == *f.ID) &&
+		(f.Principal == "" || ev.Principal == f.Principal) &&
+		(f.Since.IsZero() || !ev.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || ev.Time.Before(f.Until))
+}
+
+// limit applies the limit of f to events.
+func (f *AuditFilter) limit(events []AuditEvent) []AuditEvent {
+	if f.Limit > 0 && len(events) > f.Limit {
+		return events[len(events)-f.Limit:]
+	}
+	return events
+}
+
+// AuditSink stores audit events.  Sinks must be safe for concurrent use.
+type AuditSink interface {
+	// Record stores ev.
+	Record(ctx context.Context, ev AuditEvent) error
+
+	// Query returns the events matching filter in the order they were
+	// recorded.
+	Query(ctx context.Context, filter AuditFilter) ([]AuditEvent, error)
+}
+
+// MemoryAuditSink is an AuditSink keeping events in memory.
+type MemoryAuditSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+// NewMemoryAuditSink creates an empty MemoryAuditSink.
+func NewMemoryAuditSink() *MemoryAuditSink {
+	return &MemoryAuditSink{}
+}
+
+// Record implements the AuditSink interface.
+func (s *MemoryAuditSink) Record(ctx context.Context, ev AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, ev)
+	return nil
+}
+
+// Query implements the AuditSink interface.
+func (s *MemoryAuditSink) Query(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := []AuditEvent{}
+	for i := range s.events {
+		if filter.matches(&s.events[i]) {
+			events = append(events, s.events[i])
+		}
+	}
+	return filter.limit(events), nil
+}
+
+// FileAuditSink is an AuditSink appending events to a file as JSON lines.
+type FileAuditSink struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewFileAuditSink opens the file at path for appending audit events,
+// creating it if it doesn't exist.
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{path: path, f: f}, nil
+}
+
+// Record implements the AuditSink interface.
+func (s *FileAuditSink) Record(ctx context.Context, ev AuditEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.f.Write(b)
+	return err
+}
+
+// Query implements the AuditSink interface by reading the whole file.
+func (s *FileAuditSink) Query(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	events := []AuditEvent{}
+	dec := json.NewDecoder(f)
+	for {
+		var ev AuditEvent
+		err := dec.Decode(&ev)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if filter.matches(&ev) {
+			events = append(events, ev)
+		}
+	}
+	return filter.limit(events), nil
+}
+
+// Close closes the file.
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// WithAudit records an AuditEvent in sink for every successful change to a
+// record of the service.  The events are listed by the service's audit
+// route, filtered by the query parameters id, principal, since and until
+// (RFC 3339 times) and limit.  The audit route of a child service lists the
+// events of the records below the parent records in its path.
+func WithAudit(sink AuditSink) ServiceOption {
+	return func(e *endpoint) {
+		e.auditSink = sink
+	}
+}
+
+// auditBefore returns the record to audit as the state before a change, or
+// nil if the service is not audited or the record can't be read.
+func (e *endpoint) auditBefore(ctx context.Context, id int) interface{} {
+	if e.auditSink == nil {
+		return nil
+	}
+	data, err := e.getRecord(ctx, id)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// changedFields lists the top-level fields that differ between the JSON
+// objects before and after.
+func changedFields(before, after json.RawMessage) []string {
+	var b, a map[string]json.RawMessage
+	json.Unmarshal(before, &b)
+	json.Unmarshal(after, &a)
+
+	var changed []string
+	for k, v := range b {
+		if w, ok := a[k]; !ok || !bytes.Equal(v, w) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// audit records a change to record id.  Failures are logged, as the change
+// has been made.
+func (e *endpoint) audit(ctx context.Context, op Operation, id int, before, after interface{}) {
+	if e.auditSink == nil {
+		return
+	}
+
+	ev := AuditEvent{
+		Time:      time.Now().UTC(),
+		Tenant:    TenantFromContext(ctx),
+		Principal: PrincipalFromContext(ctx),
+		RequestID: RequestIDFromContext(ctx),
+		Prefix:    e.prefix,
+		Operation: op,
+		ID:        id,
+		Parents:   parentIDs(ctx),
+	}
+	for _, snapshot := range []struct {
+		data interface{}
+		raw  *json.RawMessage
+	}{{before, &ev.Before}, {after, &ev.After}} {
+		if snapshot.data == nil || reflect.ValueOf(snapshot.data).IsNil() {
+			continue
+		}
+		b, err := json.Marshal(snapshot.data)
+		if err != nil {
+			logError(ctx, "Audit error", err)
+			continue
+		}
+		*snapshot.raw = b
+	}
+	ev.Changed = changedFields(ev.Before, ev.After)
+
+	// The event is recorded even if the request is canceled by then, as
+	// the change has been made.
+	ctx = context.WithoutCancel(ctx)
+	afterCommit(ctx, func() {
+		err := e.auditSink.Record(ctx, ev)
+		if err != nil {
+			logError(ctx, "Audit error", err)
+		}
+	})
+}
+
+// auditFilter parses the filter of an audit request.
+func (e *endpoint) auditFilter(r *http.Request) (AuditFilter, bool) {
+	args := r.URL.Query()
+	filter := AuditFilter{
+		Tenant:    TenantFromContext(r.Context()),
+		Prefix:    e.prefix,
+		Principal: args.Get("principal"),
+		Parents:   parentIDs(r.Context()),
+	}
+	if v := args.Get("id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return filter, false
+		}
+		filter.ID = &id
+	}
+	for _, t := range []struct {
+		param string
+		time  *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if v := args.Get(t.param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, false
+			}
+			*t.time = parsed
+		}
+	}
+	if v := args.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return filter, false
+		}
+		filter.Limit = limit
+	}
+	return filter, true
+}
+
+func (e *endpoint) handleAudit(w http.ResponseWriter, r *http.Request) {
+	codec := e.codecs.responseCodec(r, typeOfAuditEvents)
+	if codec == nil {
+		http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+		return
+	}
+
+	filter, ok := e.auditFilter(r)
+	if !ok {
+		e.sendError(w, r, http.StatusBadRequest, "Invalid audit filter")
+		return
+	}
+
+	events, err := e.auditSink.Query(r.Context(), filter)
+	if e.handleCallError(r, "Audit", err, w) {
+		return
+	}
+
+	e.sendResponse(w, r, codec, events)
+}
@@ -0,0 +1,138 @@
+package lazy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	r := NewRouter()
+	sink := NewMemoryAuditSink()
+	principal := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx := ContextWithPrincipal(req.Context(), req.Header.Get("X-User"))
+			h.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+	err := r.AddService("test", NewTestService(), WithAudit(sink), WithMiddleware(principal))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+	base := fmt.Sprintf("http://%s/test", addr)
+	header := http.Header{"X-User": {"alice"}}
+
+	testVersionReq(t, "POST", base+"/new", header, `{"Name": "One"}`, nil)
+	testVersionReq(t, "PUT", base+"/put/1", header, `{"Name": "Uno"}`, nil)
+	testVersionReq(t, "PUT", base+"/put/9", header, `{"Name": "Missing"}`, nil)
+	testVersionReq(t, "GET", base+"/delete/1", nil, "", nil)
+
+	var events []AuditEvent
+	resp := testVersionReq(t, "GET", base+"/audit?id=1", nil, "", &events)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected audit to succeed, got %d", resp.StatusCode)
+	}
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events for successful changes, got %+v", events)
+	}
+	for i, want := range []struct {
+		op        Operation
+		principal string
+		changed   []string
+	}{
+		{OpNew, "alice", []string{"ID", "Name"}},
+		{OpPut, "alice", []string{"Name"}},
+		{OpDelete, "", []string{"ID", "Name"}},
+	} {
+		ev := events[i]
+		if ev.Operation != want.op || ev.Principal != want.principal || ev.Prefix != "test" ||
+			!reflect.DeepEqual(ev.Changed, want.changed) {
+			t.Errorf("Unexpected event %d %+v", i, ev)
+		}
+	}
+	if string(events[1].Before) != `{"ID":1,"Name":"One"}` || string(events[1].After) != `{"ID":1,"Name":"Uno"}` {
+		t.Errorf("Unexpected put snapshots %s %s", events[1].Before, events[1].After)
+	}
+	if events[2].After != nil {
+		t.Errorf("Unexpected after snapshot of delete %s", events[2].After)
+	}
+
+	testVersionReq(t, "GET", base+"/audit?principal=alice&limit=1", nil, "", &events)
+	if len(events) != 1 || events[0].Operation != OpPut {
+		t.Errorf("Expected latest event by alice, got %+v", events)
+	}
+	resp = testVersionReq(t, "GET", base+"/audit?since=yesterday", nil, "", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid filter, got %d", resp.StatusCode)
+	}
+}
+
+func TestAuditChildService(t *testing.T) {
+	r := NewRouter()
+	sink := NewMemoryAuditSink()
+	parents := NewTestService()
+	parents.New(context.Background(), &TestData{Name: "Parent 1"})
+	parents.New(context.Background(), &TestData{Name: "Parent 2"})
+	kids := &KidsTestService{TestService: *NewTestService(), parents: map[int]int{}}
+	if err := r.AddService("parents", parents); err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	if err := r.AddChildService("parents", "kids", kids, WithAudit(sink)); err != nil {
+		t.Fatalf("Can't add child service: %v", err)
+	}
+	addr := startTestServer(t, r)
+	base := func(parent int) string { return fmt.Sprintf("http://%s/parents/%d/kids", addr, parent) }
+
+	testVersionReq(t, "POST", base(1)+"/new", nil, `{"Name": "Kid of 1"}`, nil)
+	testVersionReq(t, "POST", base(2)+"/new", nil, `{"Name": "Kid of 2"}`, nil)
+
+	for parent, name := range map[int]string{1: "Kid of 1", 2: "Kid of 2"} {
+		var events []AuditEvent
+		testVersionReq(t, "GET", base(parent)+"/audit", nil, "", &events)
+		if len(events) != 1 || events[0].Parents["parents"] != parent ||
+			string(events[0].After) != fmt.Sprintf(`{"ID":%d,"Name":%q}`, parent, name) {
+			t.Errorf("Expected the event of parent %d only, got %+v", parent, events)
+		}
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileAuditSink(path)
+	if err != nil {
+		t.Fatalf("Can't open sink: %v", err)
+	}
+	ctx := context.Background()
+	for id := 1; id <= 3; id++ {
+		err = sink.Record(ctx, AuditEvent{Prefix: "test", Operation: OpNew, ID: id})
+		if err != nil {
+			t.Fatalf("Can't record event: %v", err)
+		}
+	}
+	sink.Close()
+
+	// Reopening appends to the existing events.
+	sink, err = NewFileAuditSink(path)
+	if err != nil {
+		t.Fatalf("Can't reopen sink: %v", err)
+	}
+	defer sink.Close()
+	sink.Record(ctx, AuditEvent{Prefix: "other", Operation: OpDelete, ID: 1})
+
+	id := 1
+	events, err := sink.Query(ctx, AuditFilter{ID: &id})
+	if err != nil {
+		t.Fatalf("Query error: %v", err)
+	}
+	if len(events) != 2 || events[1].Prefix != "other" {
+		t.Errorf("Unexpected events %+v", events)
+	}
+	events, _ = sink.Query(ctx, AuditFilter{Prefix: "test", Limit: 2})
+	if len(events) != 2 || events[0].ID != 2 {
+		t.Errorf("Expected the 2 latest test events, got %+v", events)
+	}
+}
@@ -360,7 +360,7 @@ func TestBadService(t *testing.T) {
 	for _, test := range tests {
 		err := r.AddService("test", test.service)
 		if err == nil {
-			t.Errorf(test.errorMsg)
+			t.Error(test.errorMsg)
 		}
 	}
 }
@@ -0,0 +1,201 @@
+package lazy
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the number of results a service cache keeps if its
+// CachePolicy does not set a size.
+const DefaultCacheSize = 1024
+
+// CachePolicy configures the result cache of a service.
+type CachePolicy struct {
+	// Size is the maximum number of Get and Query results kept.  The least
+	// recently used results are evicted first.
+	Size int
+
+	// TTL is how long results are kept.  If zero, results are kept until
+	// evicted or invalidated.
+	TTL time.Duration
+
+	// CacheControl is sent in the Cache-Control header of successful Get
+	// and Query responses.  If empty, "max-age" is set from TTL, or
+	// "no-cache" is sent if TTL is zero.
+	CacheControl string
+}
+
+// WithCache caches the results of the service's Get and Query methods
+// according to policy.  The cache is invalidated when New, Put or Delete
+// succeed on the service.  Cached results are shared between requests, so
+// services must not modify records they have returned.
+func WithCache(policy CachePolicy) ServiceOption {
+	return func(e *endpoint) {
+		e.cache = newResultCache(policy)
+	}
+}
+
+// cacheKey identifies a cached result of a tenant: a record for Get or a
+// list of records for Query.
+type cacheKey struct {
+	tenant string
+
+	// parents are the ids of the parent records of a child service, see
+	// parentKey.
+	parents string
+
+	op   Operation
+	id   int
+	args string
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	value interface{}
+
+	// expires is the zero time if the entry does not expire.
+	expires time.Time
+}
+
+// resultCache is an LRU cache of service results whose entries expire.  A
+// nil *resultCache caches nothing.
+type resultCache struct {
+	policy CachePolicy
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+
+	// gen is incremented on every invalidation, so results fetched before
+	// one are not added after it.
+	gen uint64
+}
+
+func newResultCache(policy CachePolicy) *resultCache {
+	if policy.Size <= 0 {
+		policy.Size = DefaultCacheSize
+	}
+	if policy.CacheControl == "" {
+		if policy.TTL > 0 {
+			policy.CacheControl = fmt.Sprintf("max-age=%d", int(policy.TTL.Seconds()))
+		} else {
+			policy.CacheControl = "no-cache"
+		}
+	}
+	return &resultCache{
+		policy:  policy,
+		now:     time.Now,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached result for key.
+func (c *resultCache) get(key cacheKey) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && !c.now().Before(entry.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.value, true
+}
+
+// generation returns the generation to pass to add for a result about to be
+// fetched.
+func (c *resultCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// add caches value for key unless the cache was invalidated since gen.
+func (c *resultCache) add(gen uint64, key cacheKey, value interface{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	entry := &cacheEntry{key: key, value: value}
+	if c.policy.TTL > 0 {
+		entry.expires = c.now().Add(c.policy.TTL)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.policy.Size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate drops the records of tenant with ids and all query results of
+// tenant.
+func (c *resultCache) invalidate(tenant string, ids ...int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	stale := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		stale[id] = true
+	}
+	// Records of child services are dropped below every parent, as their
+	// ids may be shared.
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		key := elem.Value.(*cacheEntry).key
+		if key.tenant == tenant && (key.op == OpQuery || key.op == OpGet && stale[key.id]) {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// invalidate drops the cached results of the tenant of ctx that a change to
+// the records with ids makes stale, now and again once the transaction of ctx
+// has been committed.
+func (e *endpoint) invalidate(ctx context.Context, ids ...int) {
+	tenant := TenantFromContext(ctx)
+	e.cache.invalidate(tenant, ids...)
+	afterCommit(ctx, func() { e.cache.invalidate(tenant, ids...) })
+}
+
+func (c *resultCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+// setCacheControl sets the Cache-Control header of a successful Get or Query
+// response.
+func (c *resultCache) setCacheControl(w http.ResponseWriter) {
+	if c == nil {
+		return
+	}
+	w.Header().Set("Cache-Control", c.policy.CacheControl)
+}
@@ -0,0 +1,217 @@
+package lazy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type CountingTestService struct {
+	TestService
+	Gets    int
+	Queries int
+}
+
+func (s *CountingTestService) Get(ctx context.Context, id int) (*TestData, error) {
+	s.Gets++
+	return s.TestService.Get(ctx, id)
+}
+
+func (s *CountingTestService) Query(ctx context.Context, args url.Values) ([]*TestData, error) {
+	s.Queries++
+	return s.TestService.Query(ctx, args)
+}
+
+func TestCache(t *testing.T) {
+	r := NewRouter()
+	s := &CountingTestService{TestService: *NewTestService()}
+	err := r.AddService("test", s, WithCache(CachePolicy{TTL: time.Minute}))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	testAndValidateNewReq(t, addr, &TestData{ID: 1, Name: "Test 1"})
+	testAndValidateNewReq(t, addr, &TestData{ID: 2, Name: "Test 2"})
+
+	for i := 0; i < 3; i++ {
+		testAndValidateGetReq(t, addr, 1, "Test 1")
+	}
+	if s.Gets != 1 {
+		t.Errorf("Expected 1 Get call, got %d", s.Gets)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/test/get/1", addr))
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Cache-Control") != "max-age=60" {
+		t.Errorf("Unexpected Cache-Control %q", resp.Header.Get("Cache-Control"))
+	}
+
+	// Query args are normalized.
+	testQueryReq(addr, "?a=1&b=2")
+	testQueryReq(addr, "?b=2&a=1")
+	testQueryReq(addr, "?a=2")
+	if s.Queries != 2 {
+		t.Errorf("Expected 2 Query calls, got %d", s.Queries)
+	}
+
+	// Mutations invalidate the record and all queries.
+	testAndValidatePutReq(t, addr, &TestData{ID: 1, Name: "Test 1 updated"})
+	testAndValidateGetReq(t, addr, 1, "Test 1 updated")
+	testAndValidateGetReq(t, addr, 2, "Test 2")
+	testAndValidateGetReq(t, addr, 2, "Test 2")
+	if s.Gets != 3 {
+		t.Errorf("Expected 3 Get calls, got %d", s.Gets)
+	}
+	results, _ := testQueryReq(addr, "?a=1&b=2")
+	if s.Queries != 3 || len(results) != 2 || results[0].Name != "Test 1 updated" {
+		t.Errorf("Expected fresh query results, got %v after %d calls", results, s.Queries)
+	}
+
+	testAndValidateNewReq(t, addr, &TestData{ID: 3, Name: "Test 3"})
+	results, _ = testQueryReq(addr, "?a=1&b=2")
+	if len(results) != 3 {
+		t.Errorf("Expected query to see new record, got %v", results)
+	}
+
+	testAndValidateDeleteReq(t, addr, 2)
+	_, err = testGetReq(addr, 2)
+	if err == nil {
+		t.Errorf("Expected deleted record to be gone")
+	}
+}
+
+// KidsTestService keeps the records of each parent apart.
+type KidsTestService struct {
+	TestService
+	parents map[int]int
+}
+
+func (s *KidsTestService) Get(ctx context.Context, id int) (*TestData, error) {
+	if parent, _ := ParentID(ctx, "parents"); s.parents[id] != parent {
+		return nil, fmt.Errorf("ID %d does not exist", id)
+	}
+	return s.TestService.Get(ctx, id)
+}
+
+func (s *KidsTestService) New(ctx context.Context, data *TestData) (int, error) {
+	id, err := s.TestService.New(ctx, data)
+	s.parents[id], _ = ParentID(ctx, "parents")
+	return id, err
+}
+
+func (s *KidsTestService) Query(ctx context.Context, args url.Values) ([]*TestData, error) {
+	parent, _ := ParentID(ctx, "parents")
+	all, err := s.TestService.Query(ctx, args)
+	var results []*TestData
+	for _, data := range all {
+		if s.parents[data.ID] == parent {
+			results = append(results, data)
+		}
+	}
+	return results, err
+}
+
+func TestCacheChildService(t *testing.T) {
+	r := NewRouter()
+	parents := NewTestService()
+	parents.New(context.Background(), &TestData{Name: "Parent 1"})
+	parents.New(context.Background(), &TestData{Name: "Parent 2"})
+	kids := &KidsTestService{TestService: *NewTestService(), parents: map[int]int{}}
+	if err := r.AddService("parents", parents); err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	if err := r.AddChildService("parents", "kids", kids, WithCache(CachePolicy{TTL: time.Minute})); err != nil {
+		t.Fatalf("Can't add child service: %v", err)
+	}
+	addr := startTestServer(t, r)
+	base := func(parent int) string { return fmt.Sprintf("http://%s/parents/%d/kids", addr, parent) }
+
+	testVersionReq(t, "POST", base(1)+"/new", nil, `{"Name": "Kid of 1"}`, nil)
+	testVersionReq(t, "POST", base(2)+"/new", nil, `{"Name": "Kid of 2"}`, nil)
+
+	for _, parent := range []int{1, 2, 1, 2} {
+		var results []*TestData
+		testVersionReq(t, "GET", base(parent)+"/query", nil, "", &results)
+		if expected := fmt.Sprintf("Kid of %d", parent); len(results) != 1 || results[0].Name != expected {
+			t.Errorf("Expected %s from parent %d, got %+v", expected, parent, results)
+		}
+	}
+
+	var data TestData
+	if resp := testVersionReq(t, "GET", base(1)+"/get/1", nil, "", &data); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected kid of parent 1 to be found, got %d", resp.StatusCode)
+	}
+	if resp := testVersionReq(t, "GET", base(2)+"/get/1", nil, "", nil); resp.StatusCode == http.StatusOK {
+		t.Errorf("Expected kid of parent 1 not to be found below parent 2")
+	}
+
+	// Changes below one parent invalidate the record below all of them.
+	testVersionReq(t, "PUT", base(1)+"/put/1", nil, `{"Name": "Renamed"}`, nil)
+	testVersionReq(t, "GET", base(1)+"/get/1", nil, "", &data)
+	if data.Name != "Renamed" {
+		t.Errorf("Expected fresh record, got %+v", data)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newResultCache(CachePolicy{Size: 2, TTL: time.Minute, CacheControl: "private"})
+	c.now = func() time.Time { return now }
+
+	key := func(id int) cacheKey { return cacheKey{op: OpGet, id: id} }
+	c.add(c.generation(), key(1), 1)
+	c.add(c.generation(), key(2), 2)
+	c.get(key(1))
+	c.add(c.generation(), key(3), 3)
+	if _, ok := c.get(key(2)); ok {
+		t.Errorf("Expected least recently used entry to be evicted")
+	}
+	if v, ok := c.get(key(1)); !ok || v != 1 {
+		t.Errorf("Expected recently used entry to be kept, got %v", v)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get(key(1)); ok {
+		t.Errorf("Expected entry to expire")
+	}
+
+	// Results fetched before an invalidation are not added.
+	gen := c.generation()
+	c.invalidate("", 4)
+	c.add(gen, key(4), 4)
+	if _, ok := c.get(key(4)); ok {
+		t.Errorf("Expected stale result to be dropped")
+	}
+
+	w := NewDummyResponseWriter()
+	c.setCacheControl(w)
+	if w.Header().Get("Cache-Control") != "private" {
+		t.Errorf("Expected policy Cache-Control, got %q", w.Header().Get("Cache-Control"))
+	}
+}
+
+func TestResultCacheNoTTL(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newResultCache(CachePolicy{Size: 100})
+	c.now = func() time.Time { return now }
+
+	key := cacheKey{op: OpGet, id: 1}
+	c.add(c.generation(), key, 1)
+	now = now.Add(24 * time.Hour)
+	if v, ok := c.get(key); !ok || v != 1 {
+		t.Errorf("Expected entry without TTL to be kept, got %v", v)
+	}
+
+	w := NewDummyResponseWriter()
+	c.setCacheControl(w)
+	if w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("Expected no-cache without TTL, got %q", w.Header().Get("Cache-Control"))
+	}
+}
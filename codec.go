@@ -0,0 +1,198 @@
+package lazy
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Codec marshals and unmarshals request and response bodies for a single
+// media type.
+type Codec interface {
+	// ContentType returns the media type handled by the codec, such as
+	// "application/json".
+	ContentType() string
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// TypedCodec is a Codec that can only handle some service data types.  It is
+// offered during content negotiation only for services whose data type it
+// supports.
+type TypedCodec interface {
+	Codec
+
+	// Supports reports whether the codec can handle dataType, the pointer
+	// type returned by a service's Get method.
+	Supports(dataType reflect.Type) bool
+}
+
+func codecSupports(c Codec, dataType reflect.Type) bool {
+	tc, ok := c.(TypedCodec)
+	return !ok || tc.Supports(dataType)
+}
+
+// JSONCodec encodes bodies as JSON.  It is the default codec of every Router.
+type JSONCodec struct{}
+
+// ContentType implements the Codec interface.
+func (JSONCodec) ContentType() string { return "application/json" }
+
+// Marshal implements the Codec interface.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal implements the Codec interface.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// XMLCodec encodes bodies as XML.  Routers do not offer it unless registered
+// with RegisterCodec, as XML cannot encode every data type, e.g. maps.
+type XMLCodec struct{}
+
+// ContentType implements the Codec interface.
+func (XMLCodec) ContentType() string { return "application/xml" }
+
+// Marshal implements the Codec interface.
+func (XMLCodec) Marshal(v interface{}) ([]byte, error) { return xml.Marshal(v) }
+
+// Unmarshal implements the Codec interface.
+func (XMLCodec) Unmarshal(data []byte, v interface{}) error { return xml.Unmarshal(data, v) }
+
+// codecRegistry holds the codecs known to a Router.  The first codec is the
+// default used when a request does not express a preference.
+type codecRegistry struct {
+	mu     sync.RWMutex
+	codecs []Codec
+}
+
+func newCodecRegistry(codecs ...Codec) *codecRegistry {
+	reg := &codecRegistry{}
+	for _, c := range codecs {
+		reg.register(c)
+	}
+	return reg
+}
+
+// register adds c to the registry, replacing any codec with the same
+// content type.
+func (reg *codecRegistry) register(c Codec) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for i, old := range reg.codecs {
+		if old.ContentType() == c.ContentType() {
+			reg.codecs[i] = c
+			return
+		}
+	}
+	reg.codecs = append(reg.codecs, c)
+}
+
+func (reg *codecRegistry) lookup(mediaType string, dataType reflect.Type) Codec {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	for _, c := range reg.codecs {
+		if c.ContentType() == mediaType && codecSupports(c, dataType) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (reg *codecRegistry) defaultCodec(dataType reflect.Type) Codec {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	for _, c := range reg.codecs {
+		if codecSupports(c, dataType) {
+			return c
+		}
+	}
+	return nil
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept parses an Accept header into media ranges ordered by
+// descending preference.  Ranges with a quality of 0 are dropped.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || !strings.Contains(mediaType, "/") {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	return ranges
+}
+
+func (reg *codecRegistry) match(mediaRange string, dataType reflect.Type) Codec {
+	if mediaRange == "*/*" {
+		return reg.defaultCodec(dataType)
+	}
+	if strings.HasSuffix(mediaRange, "/*") {
+		prefix := strings.TrimSuffix(mediaRange, "*")
+		reg.mu.RLock()
+		defer reg.mu.RUnlock()
+		for _, c := range reg.codecs {
+			if strings.HasPrefix(c.ContentType(), prefix) && codecSupports(c, dataType) {
+				return c
+			}
+		}
+		return nil
+	}
+	return reg.lookup(mediaRange, dataType)
+}
+
+// responseCodec selects the codec for the response to r based on its Accept
+// header.  It returns nil if none of the acceptable media types has a codec
+// supporting dataType.
+func (reg *codecRegistry) responseCodec(r *http.Request, dataType reflect.Type) Codec {
+	header := r.Header.Get("Accept")
+	if header == "" {
+		return reg.defaultCodec(dataType)
+	}
+	for _, ar := range parseAccept(header) {
+		if c := reg.match(ar.mediaType, dataType); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// requestCodec selects the codec for the body of r based on its Content-Type
+// header.  It returns nil if the content type has no codec supporting
+// dataType.
+func (reg *codecRegistry) requestCodec(r *http.Request, dataType reflect.Type) Codec {
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return reg.defaultCodec(dataType)
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return nil
+	}
+	return reg.lookup(mediaType, dataType)
+}
@@ -0,0 +1,155 @@
+package lazy
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// testCodec is a JSON codec registered under a private media type to
+// exercise user supplied codecs.
+type testCodec struct {
+	JSONCodec
+}
+
+func (testCodec) ContentType() string { return "application/x-lazy-test" }
+
+func testCodecReq(t *testing.T, method string, url string, contentType string,
+	accept string, body []byte) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Can't create request: %v", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Can't read response body: %v", err)
+	}
+	return resp, b
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	r := NewRouter()
+	r.RegisterCodec(XMLCodec{})
+	r.RegisterCodec(testCodec{})
+	s := NewTestService()
+	err := r.AddService("test", s)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	// New with an XML body.
+	body, _ := xml.Marshal(&TestData{Name: "Test 1"})
+	resp, _ := testCodecReq(t, "POST", fmt.Sprintf("http://%s/test/new", addr),
+		"application/xml", "", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected XML New to succeed, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected JSON response by default, got %s", resp.Header.Get("Content-Type"))
+	}
+
+	// Get as XML.
+	resp, b := testCodecReq(t, "GET", fmt.Sprintf("http://%s/test/get/1", addr),
+		"", "text/html;q=0.9, application/xml", nil)
+	if resp.Header.Get("Content-Type") != "application/xml" {
+		t.Errorf("Expected XML response, got %s", resp.Header.Get("Content-Type"))
+	}
+	var xmlRet struct {
+		Data TestData `xml:"data"`
+	}
+	err = xml.Unmarshal(b, &xmlRet)
+	if err != nil {
+		t.Fatalf("XML decode error: %v", err)
+	}
+	if xmlRet.Data.ID != 1 || xmlRet.Data.Name != "Test 1" {
+		t.Errorf("Unexpected XML data: %v", xmlRet.Data)
+	}
+
+	// Get using a wildcard.
+	resp, _ = testCodecReq(t, "GET", fmt.Sprintf("http://%s/test/get/1", addr),
+		"", "text/html, application/*;q=0.5", nil)
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected JSON response, got %s", resp.Header.Get("Content-Type"))
+	}
+
+	// Get using the user registered codec.
+	resp, b = testCodecReq(t, "GET", fmt.Sprintf("http://%s/test/get/1", addr),
+		"", "application/x-lazy-test", nil)
+	if resp.Header.Get("Content-Type") != "application/x-lazy-test" {
+		t.Errorf("Expected test codec response, got %s", resp.Header.Get("Content-Type"))
+	}
+	var jsonRet struct {
+		Data TestData `json:"data"`
+	}
+	err = json.Unmarshal(b, &jsonRet)
+	if err != nil {
+		t.Fatalf("Test codec decode error: %v", err)
+	}
+	if jsonRet.Data.Name != "Test 1" {
+		t.Errorf("Unexpected test codec data: %v", jsonRet.Data)
+	}
+
+	// Nothing acceptable.
+	resp, _ = testCodecReq(t, "GET", fmt.Sprintf("http://%s/test/get/1", addr),
+		"", "text/html, application/json;q=0", nil)
+	if resp.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("Expected %d, got %d", http.StatusNotAcceptable, resp.StatusCode)
+	}
+
+	// Unknown request body.
+	resp, _ = testCodecReq(t, "POST", fmt.Sprintf("http://%s/test/put/1", addr),
+		"text/csv", "", []byte("1,Test 1"))
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected %d, got %d", http.StatusUnsupportedMediaType, resp.StatusCode)
+	}
+	if s.data[1].Name != "Test 1" {
+		t.Errorf("Rejected Put modified data")
+	}
+}
+
+func TestCodecDefault(t *testing.T) {
+	r := NewRouter()
+	err := r.AddService("test", newNamedTestService("One"))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	// Browsers accept XML, which routers only offer once registered.
+	resp, _ := testCodecReq(t, "GET", fmt.Sprintf("http://%s/test/get/1", addr),
+		"", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected JSON response, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestParseAccept(t *testing.T) {
+	ranges := parseAccept("text/*;q=0.5, application/xml, bogus, application/json;q=0.8, */*;q=0")
+	expected := []string{"application/xml", "application/json", "text/*"}
+	if len(ranges) != len(expected) {
+		t.Fatalf("Expected %d ranges, got %v", len(expected), ranges)
+	}
+	for i, mediaType := range expected {
+		if ranges[i].mediaType != mediaType {
+			t.Errorf("Expected range %d to be %s, got %s", i, mediaType, ranges[i].mediaType)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package lazy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ExpandParam is the query parameter of Get and Query requests naming the
+// relations to expand.  It takes a comma-separated list and may be repeated.
+const ExpandParam = "expand"
+
+var typeOfIDs = reflect.TypeOf([]int(nil))
+
+var errBadExpand = errors.New("bad expand")
+
+// relation is a field of a service's data type holding the id of a record of
+// another service.  It is declared with a tag such as `lazy:"ref=users"`,
+// optionally naming the relation with `lazy:"ref=users,as=author"`.  The
+// default name is the field's JSON name without an "ID" suffix.
+type relation struct {
+	name   string
+	index  []int
+	target string
+}
+
+// relationName derives the default name of a relation from the JSON name of
+// its field, e.g. "author" from "authorId".
+func relationName(field string) string {
+	for _, suffix := range []string{"_id", "ID", "Id"} {
+		if len(field) > len(suffix) && strings.HasSuffix(field, suffix) {
+			return strings.TrimSuffix(field, suffix)
+		}
+	}
+	return field
+}
+
+// findRelations collects the relations declared by the service's data type.
+func (e *endpoint) findRelations() error {
+	e.relations = make(map[string]relation)
+	if e.dataType.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+
+	for _, f := range dataFields(e.dataType.Elem()) {
+		tag, ok := f.tag.Lookup("lazy")
+		if !ok {
+			continue
+		}
+		rel := relation{name: relationName(f.name), index: f.index}
+		for _, opt := range strings.Split(tag, ",") {
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("Malformed lazy tag %q on field %s", tag, f.name)
+			}
+			switch kv[0] {
+			case "ref":
+				rel.target = kv[1]
+			case "as":
+				rel.name = kv[1]
+			default:
+				return fmt.Errorf("Unknown option %s in lazy tag of field %s", kv[0], f.name)
+			}
+		}
+		if rel.target == "" {
+			return fmt.Errorf("Lazy tag of field %s has no ref", f.name)
+		}
+		if f.typ.Kind() != reflect.Int {
+			return fmt.Errorf("Reference field %s must be an int.  Found %v instead", f.name, f.typ)
+		}
+		if _, dup := e.relations[rel.name]; dup {
+			return fmt.Errorf("Duplicate relation %s", rel.name)
+		}
+		e.relations[rel.name] = rel
+	}
+	return nil
+}
+
+// findGetMulti finds the optional GetMulti method, which fetches several
+// records at once:
+//
+//	func (s *Service) GetMulti(ctx context.Context, ids []int) ([]*Data, error)
+//
+// It returns a record, or nil if it does not exist, for every id.
+func (e *endpoint) findGetMulti() error {
+	method, ok := e.serviceType.MethodByName("GetMulti")
+	if !ok {
+		return nil
+	}
+
+	t := method.Type
+	if t.NumIn() != 3 || t.In(1) != typeOfContext || t.In(2) != typeOfIDs {
+		return fmt.Errorf("GetMulti method must take a context.Context and []int")
+	}
+	if t.NumOut() != 2 || t.Out(0) != reflect.SliceOf(e.dataType) || t.Out(1) != typeOfError {
+		return fmt.Errorf("GetMulti method must return %v and error", reflect.SliceOf(e.dataType))
+	}
+
+	e.getMulti = &method
+	return nil
+}
+
+// doGetMany returns the records with ids that exist, using GetMulti if the
+// service has it.
+func (e *endpoint) doGetMany(ctx context.Context, ids []int) (map[int]interface{}, error) {
+	records := make(map[int]interface{})
+	if e.getMulti == nil {
+		for _, id := range ids {
+			data, err := e.doGet(ctx, id)
+			if isCallFailure(err) {
+				return nil, err
+			}
+			if err == nil {
+				records[id] = data
+			}
+		}
+		return records, nil
+	}
+
+	ctx, cancel := e.operationContext(ctx, OpGet)
+	defer cancel()
+
+	values := e.call(ctx, *e.getMulti, reflect.ValueOf(ids))
+	if err := callError(values[1]); err != nil {
+		return nil, err
+	}
+	results := values[0]
+	if results.Len() != len(ids) {
+		return nil, fmt.Errorf("GetMulti returned %d records for %d ids", results.Len(), len(ids))
+	}
+	for i, id := range ids {
+		if record := results.Index(i); !record.IsNil() && !e.hidden(ctx, record) {
+			records[id] = record.Interface()
+		}
+	}
+	return records, nil
+}
+
+// getRelated returns the records with ids that exist, for embedding in the
+// response to another service.  Every record is requested through the Get
+// handler, so that the service's limits and middleware apply to it as they
+// do to REST requests.  The first request fetches all records if the
+// service has GetMulti.
+func (e *endpoint) getRelated(ctx context.Context, ids []int) (map[int]interface{}, error) {
+	records := make(map[int]interface{})
+	fetched := false
+	for _, id := range ids {
+		_, err := e.operate(ctx, OpGet, id, nil, nil, func(ctx context.Context) (interface{}, error) {
+			if fetched {
+				return nil, nil
+			}
+			batch := []int{id}
+			if e.getMulti != nil {
+				batch, fetched = ids, true
+			}
+			found, err := e.doGetMany(ctx, batch)
+			for id, record := range found {
+				records[id] = record
+			}
+			return nil, err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// expandNames returns the relations requested in args.
+func expandNames(args url.Values) []string {
+	var names []string
+	for _, v := range args[ExpandParam] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// expand returns the JSON form of data, a record or a slice of records, with
+// the related records of every relation in names embedded under the
+// relation's name.  Missing related records are embedded as null.
+func (e *endpoint) expand(ctx context.Context, data interface{}, names []string) (interface{}, error) {
+	var rels []relation
+	for _, name := range names {
+		rel, ok := e.relations[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown relation %s", errBadExpand, name)
+		}
+		rels = append(rels, rel)
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	err = json.Unmarshal(b, &generic)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pair each record with its JSON object.
+	v := reflect.ValueOf(data)
+	var records []reflect.Value
+	var objects []map[string]interface{}
+	add := func(record reflect.Value, object interface{}) {
+		if m, ok := object.(map[string]interface{}); ok && !record.IsNil() {
+			records = append(records, record.Elem())
+			objects = append(objects, m)
+		}
+	}
+	if v.Kind() == reflect.Slice {
+		list, _ := generic.([]interface{})
+		for i := 0; i < v.Len() && i < len(list); i++ {
+			add(v.Index(i), list[i])
+		}
+	} else if v.Kind() == reflect.Ptr {
+		add(v, generic)
+	}
+
+	for _, rel := range rels {
+		target, ok := e.router.endpoint(rel.target)
+		if !ok || target.parent != nil {
+			return nil, fmt.Errorf("Relation %s of %s refers to unknown service %s", rel.name, e.prefix, rel.target)
+		}
+
+		seen := make(map[int]bool)
+		var ids []int
+		for _, record := range records {
+			id := int(record.FieldByIndex(rel.index).Int())
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		sort.Ints(ids)
+
+		related, err := target.getRelated(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for i, record := range records {
+			objects[i][rel.name] = related[int(record.FieldByIndex(rel.index).Int())]
+		}
+	}
+	return generic, nil
+}
+
+// expandResponse expands the relations requested by r in data, the result of
+// a Get or Query.  On failure, an error is sent and false returned.
+func (e *endpoint) expandResponse(w http.ResponseWriter, r *http.Request, codec Codec, data interface{}) (interface{}, bool) {
+	names := expandNames(r.URL.Query())
+	if len(names) == 0 {
+		return data, true
+	}
+	if codec.ContentType() != (JSONCodec{}).ContentType() {
+		e.sendError(w, r, http.StatusNotAcceptable, "Expanding relations requires a JSON response")
+		return nil, false
+	}
+
+	data, err := e.expand(contextWithTransportRequest(r.Context(), r), data, names)
+	if errors.Is(err, errBadExpand) {
+		e.sendError(w, r, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	var rejected *callRejectedError
+	if errors.As(err, &rejected) {
+		e.sendError(w, r, rejected.status, rejected.msg)
+		return nil, false
+	}
+	if e.handleCallError(r, "Expand", err, w) {
+		return nil, false
+	}
+	return data, true
+}
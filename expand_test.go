@@ -0,0 +1,251 @@
+package lazy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+type ExpandTestPost struct {
+	ID       int    `json:"id"`
+	Title    string `json:"title"`
+	AuthorID int    `json:"authorId" lazy:"ref=users"`
+	EditorID int    `json:"editorId" lazy:"ref=users,as=reviewer"`
+}
+
+type ExpandTestPostService struct {
+	posts []*ExpandTestPost
+}
+
+func (s *ExpandTestPostService) Get(ctx context.Context, id int) (*ExpandTestPost, error) {
+	for _, p := range s.posts {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("ID %d does not exist", id)
+}
+
+func (s *ExpandTestPostService) Put(ctx context.Context, id int, data *ExpandTestPost) error {
+	return fmt.Errorf("Not supported")
+}
+
+func (s *ExpandTestPostService) New(ctx context.Context, data *ExpandTestPost) (int, error) {
+	return 0, fmt.Errorf("Not supported")
+}
+
+func (s *ExpandTestPostService) Delete(ctx context.Context, id int) error {
+	return fmt.Errorf("Not supported")
+}
+
+func (s *ExpandTestPostService) Query(ctx context.Context, args url.Values) ([]*ExpandTestPost, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("Unexpected args %v", args)
+	}
+	return s.posts, nil
+}
+
+type MultiGetTestService struct {
+	TestService
+	Gets      int
+	MultiGets [][]int
+}
+
+func (s *MultiGetTestService) Get(ctx context.Context, id int) (*TestData, error) {
+	s.Gets++
+	return s.TestService.Get(ctx, id)
+}
+
+func (s *MultiGetTestService) GetMulti(ctx context.Context, ids []int) ([]*TestData, error) {
+	s.MultiGets = append(s.MultiGets, ids)
+	results := make([]*TestData, len(ids))
+	for i, id := range ids {
+		results[i] = s.data[id]
+	}
+	return results, nil
+}
+
+type BadRefTestData struct {
+	Ref string `lazy:"ref=users"`
+}
+
+type BadRefTestService struct{}
+
+func (s *BadRefTestService) Get(ctx context.Context, id int) (*BadRefTestData, error) {
+	return nil, nil
+}
+
+func (s *BadRefTestService) Put(ctx context.Context, id int, data *BadRefTestData) error {
+	return nil
+}
+
+func (s *BadRefTestService) New(ctx context.Context, data *BadRefTestData) (int, error) {
+	return 0, nil
+}
+
+func (s *BadRefTestService) Delete(ctx context.Context, id int) error {
+	return nil
+}
+
+func (s *BadRefTestService) Query(ctx context.Context, args url.Values) ([]*BadRefTestData, error) {
+	return nil, nil
+}
+
+func testExpandReq(t *testing.T, addr string, path string, data interface{}) int {
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", addr, path))
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode
+	}
+
+	ret := Response{Data: data}
+	err = json.NewDecoder(resp.Body).Decode(&ret)
+	if err != nil {
+		t.Fatalf("Can't decode %s response: %v", path, err)
+	}
+	return resp.StatusCode
+}
+
+func TestExpand(t *testing.T) {
+	r := NewRouter()
+	r.RegisterCodec(XMLCodec{})
+	users := &MultiGetTestService{TestService: *NewTestService()}
+	users.data[1] = &TestData{ID: 1, Name: "Ann"}
+	users.data[2] = &TestData{ID: 2, Name: "Bob"}
+	posts := &ExpandTestPostService{posts: []*ExpandTestPost{
+		{ID: 1, Title: "First", AuthorID: 1, EditorID: 2},
+		{ID: 2, Title: "Second", AuthorID: 1, EditorID: 3},
+	}}
+	err := r.AddService("posts", posts)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	err = r.AddService("users", users)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	err = r.AddService("test", NewTestService())
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	type expandedPost struct {
+		ExpandTestPost
+		Author   *TestData `json:"author"`
+		Reviewer *TestData `json:"reviewer"`
+	}
+
+	var post expandedPost
+	status := testExpandReq(t, addr, "/posts/get/1?expand=author", &post)
+	if status != http.StatusOK {
+		t.Fatalf("Expected expanded Get to succeed, got %d", status)
+	}
+	if post.Title != "First" || post.Author == nil || post.Author.Name != "Ann" || post.Reviewer != nil {
+		t.Errorf("Unexpected expanded post %+v", post)
+	}
+
+	// Related records are fetched once per relation, with GetMulti.
+	users.MultiGets = nil
+	var list []expandedPost
+	status = testExpandReq(t, addr, "/posts/query?expand=author,reviewer", &list)
+	if status != http.StatusOK {
+		t.Fatalf("Expected expanded Query to succeed, got %d", status)
+	}
+	if len(list) != 2 || list[0].Author.Name != "Ann" || list[1].Author.Name != "Ann" ||
+		list[0].Reviewer.Name != "Bob" || list[1].Reviewer != nil {
+		t.Errorf("Unexpected expanded posts %+v", list)
+	}
+	if len(users.MultiGets) != 2 || len(users.MultiGets[0]) != 1 || len(users.MultiGets[1]) != 2 {
+		t.Errorf("Expected one GetMulti per relation, got %v", users.MultiGets)
+	}
+	if users.Gets != 0 {
+		t.Errorf("Expected no single Gets, got %d", users.Gets)
+	}
+
+	for path, expected := range map[string]int{
+		"/posts/get/1?expand=comments": http.StatusBadRequest,
+		"/posts/query?expand=comments": http.StatusBadRequest,
+	} {
+		if status := testExpandReq(t, addr, path, nil); status != expected {
+			t.Errorf("Expected %d from %s, got %d", expected, path, status)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/posts/get/1?expand=author", addr), nil)
+	req.Header.Set("Accept", "application/xml")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("Expected 406 expanding into XML, got %d", resp.StatusCode)
+	}
+
+	err = NewRouter().AddService("bad", &BadRefTestService{})
+	if err == nil {
+		t.Errorf("Expected error adding service with non-int reference")
+	}
+}
+
+func TestExpandMiddleware(t *testing.T) {
+	r := NewRouter()
+	users := &MultiGetTestService{TestService: *NewTestService()}
+	users.data[1] = &TestData{ID: 1, Name: "Ann"}
+	deny := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("X-User") != "admin" {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, req)
+		})
+	}
+	err := r.AddService("users", users, WithMiddleware(deny))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	posts := &ExpandTestPostService{posts: []*ExpandTestPost{{ID: 1, Title: "First", AuthorID: 1}}}
+	err = r.AddService("posts", posts)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+	url := fmt.Sprintf("http://%s/posts/get/1?expand=author", addr)
+
+	// Related records are requested with the headers of the request.
+	if status := testActionReq(t, "GET", url, "", nil); status != http.StatusForbidden {
+		t.Errorf("Expected expansion to be denied, got %d", status)
+	}
+	var post struct {
+		Author *TestData `json:"author"`
+	}
+	resp := testVersionReq(t, "GET", url, http.Header{"X-User": {"admin"}}, "", &post)
+	if resp.StatusCode != http.StatusOK || post.Author == nil || post.Author.Name != "Ann" {
+		t.Errorf("Expected expansion to be allowed, got %d %+v", resp.StatusCode, post)
+	}
+	if len(users.MultiGets) != 1 {
+		t.Errorf("Expected one GetMulti, got %v", users.MultiGets)
+	}
+}
+
+func TestRelationName(t *testing.T) {
+	for field, expected := range map[string]string{
+		"authorId":  "author",
+		"AuthorID":  "Author",
+		"author_id": "author",
+		"owner":     "owner",
+		"Id":        "Id",
+	} {
+		if name := relationName(field); name != expected {
+			t.Errorf("Expected relation name %s for %s, got %s", expected, field, name)
+		}
+	}
+}
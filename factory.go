@@ -0,0 +1,173 @@
+package lazy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+var errScopeClosed = errors.New("request scope closed")
+
+// isServiceFactory reports whether service is a service factory, a function
+// with the signature func(ctx context.Context) (Service, error).
+func isServiceFactory(service interface{}) bool {
+	t := reflect.TypeOf(service)
+	return t != nil && t.Kind() == reflect.Func &&
+		t.NumIn() == 1 && t.In(0) == typeOfContext &&
+		t.NumOut() == 2 && t.Out(1) == typeOfError
+}
+
+// serviceScope holds the service instances created by service factories for
+// a request.  Instances are closed when the scope is closed and no method
+// call on them is running.
+type serviceScope struct {
+	ctx context.Context
+
+	mu        sync.Mutex
+	instances map[*endpoint]reflect.Value
+	cancels   []context.CancelFunc
+	running   int
+	closed    bool
+}
+
+type serviceScopeKey struct{}
+
+// openServiceScope returns a copy of ctx with a service scope and the
+// function closing it.  If ctx already has a scope, it is shared and the
+// function does nothing.
+func openServiceScope(ctx context.Context) (context.Context, func()) {
+	if _, ok := ctx.Value(serviceScopeKey{}).(*serviceScope); ok {
+		return ctx, func() {}
+	}
+	s := &serviceScope{instances: make(map[*endpoint]reflect.Value)}
+	ctx = context.WithValue(ctx, serviceScopeKey{}, s)
+	s.ctx = ctx
+	return ctx, s.close
+}
+
+// withServiceScope wraps h to run requests in a service scope that is closed
+// once h has written the response.
+func withServiceScope(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, closeScope := openServiceScope(r.Context())
+		defer closeScope()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// acquire returns the instance of the service of e in the scope, creating it
+// on first use.  Each call must be paired with a call to release.
+//
+// Instances are created with a context that has the values of ctx, the
+// context of the method call, e.g. those set by middleware, but that is only
+// canceled with the scope, as instances outlive the call creating them.
+func (s *serviceScope) acquire(ctx context.Context, e *endpoint) (reflect.Value, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return reflect.Value{}, errScopeClosed
+	}
+	instance, ok := s.instances[e]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		stop := context.AfterFunc(s.ctx, cancel)
+		s.cancels = append(s.cancels, func() {
+			stop()
+			cancel()
+		})
+		out := e.factory.Call([]reflect.Value{reflect.ValueOf(ctx)})
+		if err := callError(out[1]); err != nil {
+			return reflect.Value{}, fmt.Errorf("Can't create service %s: %w", e.prefix, err)
+		}
+		instance = out[0]
+		s.instances[e] = instance
+	}
+	s.running++
+	return instance, nil
+}
+
+// release ends a method call on an instance returned by acquire.
+func (s *serviceScope) release() {
+	s.mu.Lock()
+	s.running--
+	done := s.closed && s.running == 0
+	s.mu.Unlock()
+
+	if done {
+		s.closeInstances()
+	}
+}
+
+// close closes the scope.  Its instances are closed now if no method call is
+// running, and otherwise when the last call returns.
+func (s *serviceScope) close() {
+	s.mu.Lock()
+	s.closed = true
+	done := s.running == 0
+	s.mu.Unlock()
+
+	if done {
+		s.closeInstances()
+	}
+}
+
+// closeInstances calls the Close method of the instances that have one, and
+// then cancels the contexts they were created with.  Errors are logged.
+func (s *serviceScope) closeInstances() {
+	s.mu.Lock()
+	instances, cancels := s.instances, s.cancels
+	s.instances, s.cancels = nil, nil
+	s.mu.Unlock()
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+
+	for e, instance := range instances {
+		closer, ok := instance.Interface().(io.Closer)
+		if !ok {
+			continue
+		}
+		err := closer.Close()
+		if err != nil {
+			logError(s.ctx, "Close error", fmt.Errorf("%s: %w", e.prefix, err))
+		}
+	}
+}
+
+// receiver returns the service instance to call methods on for ctx and the
+// function to call when the call has returned.
+func (e *endpoint) receiver(ctx context.Context) (reflect.Value, func(), error) {
+	switch {
+	case e.factory.IsValid():
+		s, ok := ctx.Value(serviceScopeKey{}).(*serviceScope)
+		if !ok {
+			// Calls outside a request get an instance of their own.
+			ctx, closeScope := openServiceScope(ctx)
+			defer closeScope()
+			s = ctx.Value(serviceScopeKey{}).(*serviceScope)
+		}
+		instance, err := s.acquire(ctx, e)
+		if err != nil {
+			return reflect.Value{}, nil, err
+		}
+		return instance, s.release, nil
+
+	case e.tenantServices != nil:
+		tenant := TenantFromContext(ctx)
+		if tenant == "" {
+			return reflect.Value{}, nil, errNoTenant
+		}
+		instance, err := e.tenantServices.instance(tenant)
+		return instance, func() {}, err
+
+	default:
+		return reflect.ValueOf(e.service), func() {}, nil
+	}
+}
@@ -0,0 +1,127 @@
+package lazy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ScopedTestService is created per request and records its lifecycle.
+type ScopedTestService struct {
+	*TestService
+	log *scopeLog
+	n   int
+}
+
+type scopeLog struct {
+	mu      sync.Mutex
+	created int
+	closed  []int
+}
+
+func (s *ScopedTestService) Close() error {
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+	s.log.closed = append(s.log.closed, s.n)
+	return nil
+}
+
+// BoundTestService fails once the context it was created with is done, like
+// a service bound to a database transaction.
+type BoundTestService struct {
+	*TestService
+	ctx context.Context
+}
+
+func (s *BoundTestService) Get(ctx context.Context, id int) (*TestData, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, fmt.Errorf("instance ctx done: %w", err)
+	}
+	return s.TestService.Get(ctx, id)
+}
+
+func (s *BoundTestService) Put(ctx context.Context, id int, data *TestData) error {
+	if err := s.ctx.Err(); err != nil {
+		return fmt.Errorf("instance ctx done: %w", err)
+	}
+	return s.TestService.Put(ctx, id, data)
+}
+
+func TestServiceFactory(t *testing.T) {
+	r := NewRouter()
+	shared := NewTestService()
+	log := &scopeLog{}
+	type userKey struct{}
+	err := r.AddService("test", func(ctx context.Context) (*ScopedTestService, error) {
+		if ctx.Value(userKey{}) == "nobody" {
+			return nil, fmt.Errorf("no access")
+		}
+		log.mu.Lock()
+		defer log.mu.Unlock()
+		log.created++
+		return &ScopedTestService{TestService: shared, log: log, n: log.created}, nil
+	}, WithAudit(NewMemoryAuditSink()), WithMiddleware(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx := context.WithValue(req.Context(), userKey{}, req.Header.Get("X-User"))
+			h.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+	base := fmt.Sprintf("http://%s/test", addr)
+
+	testVersionReq(t, "POST", base+"/new", nil, `{"Name": "One"}`, nil)
+	// The audited Put reads the record before changing it, on the same
+	// instance.
+	resp := testVersionReq(t, "PUT", base+"/put/1", nil, `{"Name": "Two"}`, nil)
+	if resp.StatusCode != http.StatusOK || shared.data[1].Name != "Two" {
+		t.Fatalf("Expected put to succeed, got %d", resp.StatusCode)
+	}
+	log.mu.Lock()
+	if log.created != 2 || len(log.closed) != 2 || log.closed[0] != 1 || log.closed[1] != 2 {
+		t.Errorf("Expected an instance per request closed after it, got %d created, %v closed",
+			log.created, log.closed)
+	}
+	log.mu.Unlock()
+
+	resp = testVersionReq(t, "GET", base+"/get/1", http.Header{"X-User": {"nobody"}}, "", nil)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected factory error to fail the request, got %d", resp.StatusCode)
+	}
+
+	// Calls outside requests get an instance of their own.
+	e := r.endpoints["test"]
+	if _, err := e.doGet(context.Background(), 1); err != nil {
+		t.Errorf("Get outside a request failed: %v", err)
+	}
+	log.mu.Lock()
+	if log.created != 3 || len(log.closed) != 3 {
+		t.Errorf("Expected instance outside a request to be closed, got %d created, %v closed",
+			log.created, log.closed)
+	}
+	log.mu.Unlock()
+}
+
+func TestServiceFactoryContext(t *testing.T) {
+	r := NewRouter()
+	shared := newNamedTestService("One")
+	err := r.AddService("test", func(ctx context.Context) (*BoundTestService, error) {
+		return &BoundTestService{TestService: shared, ctx: ctx}, nil
+	}, WithTimeout(OpGet, time.Second), WithAudit(NewMemoryAuditSink()))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	// The audited Put creates the instance in the Get of the record before
+	// the change, whose context ends first.
+	resp := testVersionReq(t, "PUT", fmt.Sprintf("http://%s/test/put/1", addr), nil, `{"Name": "Two"}`, nil)
+	if resp.StatusCode != http.StatusOK || shared.data[1].Name != "Two" {
+		t.Errorf("Expected put to succeed, got %d %+v", resp.StatusCode, shared.data[1])
+	}
+}
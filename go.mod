@@ -0,0 +1,10 @@
+module github.com/konkers/lazy
+
+go 1.23
+
+require (
+	github.com/gorilla/mux v1.8.1
+	github.com/graphql-go/graphql v0.8.1
+	github.com/phayes/freeport v0.0.0-20220201140144-74d24b5ae9f5
+	google.golang.org/protobuf v1.36.9
+)
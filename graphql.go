@@ -0,0 +1,618 @@
+package lazy
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// graphqlQueryArg is the input type of the free form args argument accepted
+// by every query field.
+var graphqlQueryArg = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "LazyQueryArg",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"name":   &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"values": &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+	},
+})
+
+// graphqlName converts s into a valid GraphQL name.
+func graphqlName(s string) string {
+	var b strings.Builder
+	for i, c := range s {
+		switch {
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			b.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(c)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+type graphqlField struct {
+	name  string
+	index []int
+	typ   reflect.Type
+}
+
+// graphqlFields lists the fields of struct type t with their names converted
+// to GraphQL names.
+func graphqlFields(t reflect.Type) []graphqlField {
+	var fields []graphqlField
+	for _, f := range dataFields(t) {
+		fields = append(fields, graphqlField{name: graphqlName(f.name), index: f.index, typ: f.typ})
+	}
+	return fields
+}
+
+func graphqlScalar(t reflect.Type) graphql.Type {
+	if isTextMarshaler(t) {
+		return graphql.String
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return graphql.Boolean
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return graphql.Int
+	case reflect.Float32, reflect.Float64:
+		return graphql.Float
+	case reflect.String:
+		return graphql.String
+	}
+	return nil
+}
+
+// graphqlValue converts a struct field to the value GraphQL expects for its
+// type.
+func graphqlValue(v reflect.Value) interface{} {
+	if isTextMarshaler(v.Type()) {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			return nil
+		}
+		m, ok := v.Interface().(encoding.TextMarshaler)
+		if !ok && v.CanAddr() {
+			m, ok = v.Addr().Interface().(encoding.TextMarshaler)
+		}
+		if !ok {
+			return nil
+		}
+		text, err := m.MarshalText()
+		if err != nil {
+			return nil
+		}
+		return string(text)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return graphqlValue(v.Elem())
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	}
+	return v.Interface()
+}
+
+func graphqlResolveField(index []int) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		v := reflect.ValueOf(p.Source)
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return nil, nil
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return nil, nil
+		}
+		f, err := v.FieldByIndexErr(index)
+		if err != nil {
+			return nil, nil
+		}
+		return graphqlValue(f), nil
+	}
+}
+
+// graphqlBuilder derives GraphQL types from Go types.
+type graphqlBuilder struct {
+	objects map[reflect.Type]*graphql.Object
+	inputs  map[reflect.Type]*graphql.InputObject
+	names   map[string]reflect.Type
+}
+
+func newGraphQLBuilder() *graphqlBuilder {
+	return &graphqlBuilder{
+		objects: make(map[reflect.Type]*graphql.Object),
+		inputs:  make(map[reflect.Type]*graphql.InputObject),
+		names:   make(map[string]reflect.Type),
+	}
+}
+
+// typeName returns a unique GraphQL type name for t.
+func (b *graphqlBuilder) typeName(t reflect.Type, suffix string) string {
+	base := graphqlName(t.Name()) + suffix
+	name := base
+	for i := 2; ; i++ {
+		other, ok := b.names[name]
+		if !ok || other == t {
+			break
+		}
+		name = fmt.Sprintf("%s%d", base, i)
+	}
+	b.names[name] = t
+	return name
+}
+
+// outputType returns the GraphQL type for t, or nil if t has no GraphQL
+// representation.
+func (b *graphqlBuilder) outputType(t reflect.Type) graphql.Output {
+	if scalar := graphqlScalar(t); scalar != nil {
+		return scalar
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.outputType(t.Elem())
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+		elem := b.outputType(t.Elem())
+		if elem == nil {
+			return nil
+		}
+		return graphql.NewList(elem)
+	case reflect.Struct:
+		if obj := b.object(t); obj != nil {
+			return obj
+		}
+	}
+	return nil
+}
+
+func (b *graphqlBuilder) object(t reflect.Type) *graphql.Object {
+	if obj, ok := b.objects[t]; ok {
+		return obj
+	}
+
+	fields := graphqlFields(t)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	// Fields are resolved lazily so that types may refer to themselves.
+	obj := graphql.NewObject(graphql.ObjectConfig{
+		Name: b.typeName(t, ""),
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			gqlFields := graphql.Fields{}
+			for _, f := range fields {
+				typ := b.outputType(f.typ)
+				if typ == nil {
+					continue
+				}
+				gqlFields[f.name] = &graphql.Field{
+					Type:    typ,
+					Resolve: graphqlResolveField(f.index),
+				}
+			}
+			return gqlFields
+		}),
+	})
+	b.objects[t] = obj
+	return obj
+}
+
+// inputType returns the GraphQL input type for t, or nil if t has no GraphQL
+// representation.
+func (b *graphqlBuilder) inputType(t reflect.Type) graphql.Input {
+	if scalar := graphqlScalar(t); scalar != nil {
+		return scalar
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.inputType(t.Elem())
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+		elem := b.inputType(t.Elem())
+		if elem == nil {
+			return nil
+		}
+		return graphql.NewList(elem)
+	case reflect.Struct:
+		if obj := b.inputObject(t); obj != nil {
+			return obj
+		}
+	}
+	return nil
+}
+
+func (b *graphqlBuilder) inputObject(t reflect.Type) *graphql.InputObject {
+	if obj, ok := b.inputs[t]; ok {
+		return obj
+	}
+
+	fields := graphqlFields(t)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	obj := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: b.typeName(t, "Input"),
+		Fields: graphql.InputObjectConfigFieldMapThunk(func() graphql.InputObjectConfigFieldMap {
+			gqlFields := graphql.InputObjectConfigFieldMap{}
+			for _, f := range fields {
+				typ := b.inputType(f.typ)
+				if typ == nil {
+					continue
+				}
+				gqlFields[f.name] = &graphql.InputObjectFieldConfig{Type: typ}
+			}
+			return gqlFields
+		}),
+	})
+	b.inputs[t] = obj
+	return obj
+}
+
+// graphqlData converts a GraphQL input object argument to the service's data
+// type.  Input field names match encoding/json names so JSON is used to do
+// the conversion.
+func (e *endpoint) graphqlData(arg interface{}) (reflect.Value, error) {
+	data := reflect.New(e.dataType.Elem())
+	b, err := json.Marshal(arg)
+	if err != nil {
+		return data, err
+	}
+	err = json.Unmarshal(b, data.Interface())
+	return data, err
+}
+
+// graphqlQueryArgs maps the arguments of a query field to url.Values.
+func graphqlQueryArgs(args map[string]interface{}) url.Values {
+	values := url.Values{}
+	for name, arg := range args {
+		if name == "args" {
+			continue
+		}
+		list, _ := arg.([]interface{})
+		for _, v := range list {
+			values.Add(name, fmt.Sprint(v))
+		}
+	}
+
+	extra, _ := args["args"].([]interface{})
+	for _, arg := range extra {
+		m, _ := arg.(map[string]interface{})
+		name, _ := m["name"].(string)
+		list, _ := m["values"].([]interface{})
+		for _, v := range list {
+			values.Add(name, fmt.Sprint(v))
+		}
+	}
+	return values
+}
+
+// addGraphQLFields adds the query and mutation fields for e.
+func (e *endpoint) addGraphQLFields(b *graphqlBuilder, query graphql.Fields, mutation graphql.Fields) error {
+	obj := b.outputType(e.dataType)
+	input := b.inputType(e.dataType)
+	if obj == nil || input == nil {
+		return fmt.Errorf("Data type %v of %s has no GraphQL representation", e.dataType, e.prefix)
+	}
+	name := graphqlName(e.prefix)
+	idArg := &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)}
+	dataArg := &graphql.ArgumentConfig{Type: graphql.NewNonNull(input)}
+
+	query[name+"_"+string(OpGet)] = &graphql.Field{
+		Type: obj,
+		Args: graphql.FieldConfigArgument{"id": idArg},
+		Resolve: e.resolver(func(p graphql.ResolveParams) (interface{}, error) {
+			id := p.Args["id"].(int)
+			return graphqlResult(e.operate(p.Context, OpGet, id, nil, nil, func(ctx context.Context) (interface{}, error) {
+				return e.doGet(ctx, id)
+			}))
+		}),
+	}
+
+	queryArgs := graphql.FieldConfigArgument{
+		"args": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphqlQueryArg))},
+	}
+	for _, f := range graphqlFields(e.dataType.Elem()) {
+		if f.name != "args" && graphqlScalar(f.typ) != nil {
+			queryArgs[f.name] = &graphql.ArgumentConfig{Type: graphql.NewList(graphql.String)}
+		}
+	}
+	query[name+"_"+string(OpQuery)] = &graphql.Field{
+		Type: graphql.NewList(obj),
+		Args: queryArgs,
+		Resolve: e.resolver(func(p graphql.ResolveParams) (interface{}, error) {
+			args := graphqlQueryArgs(p.Args)
+			return graphqlResult(e.operate(p.Context, OpQuery, 0, args, nil, func(ctx context.Context) (interface{}, error) {
+				return e.doQuery(ctx, args)
+			}))
+		}),
+	}
+
+	mutation[name+"_"+string(OpNew)] = &graphql.Field{
+		Type: graphql.Int,
+		Args: graphql.FieldConfigArgument{"data": dataArg},
+		Resolve: e.resolver(func(p graphql.ResolveParams) (interface{}, error) {
+			data, err := e.graphqlData(p.Args["data"])
+			if err != nil {
+				return nil, err
+			}
+			return graphqlResult(e.operate(p.Context, OpNew, 0, nil, data.Interface(), func(ctx context.Context) (interface{}, error) {
+				return e.doNew(ctx, data)
+			}))
+		}),
+	}
+
+	mutation[name+"_"+string(OpPut)] = &graphql.Field{
+		Type: graphql.Int,
+		Args: graphql.FieldConfigArgument{"id": idArg, "data": dataArg},
+		Resolve: e.resolver(func(p graphql.ResolveParams) (interface{}, error) {
+			id := p.Args["id"].(int)
+			data, err := e.graphqlData(p.Args["data"])
+			if err != nil {
+				return nil, err
+			}
+			return graphqlResult(e.operate(p.Context, OpPut, id, nil, data.Interface(), func(ctx context.Context) (interface{}, error) {
+				return id, e.doPut(ctx, id, data)
+			}))
+		}),
+	}
+
+	mutation[name+"_"+string(OpDelete)] = &graphql.Field{
+		Type: graphql.Int,
+		Args: graphql.FieldConfigArgument{"id": idArg},
+		Resolve: e.resolver(func(p graphql.ResolveParams) (interface{}, error) {
+			id := p.Args["id"].(int)
+			return graphqlResult(e.operate(p.Context, OpDelete, id, nil, nil, func(ctx context.Context) (interface{}, error) {
+				return id, e.doDelete(ctx, id)
+			}))
+		}),
+	}
+
+	return nil
+}
+
+// resolver wraps resolve to count as a request to the service, so that
+// removing the service waits for it.  Calls are named by their field path.
+func (e *endpoint) resolver(resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		if !e.requests.enter() {
+			return nil, fmt.Errorf("Service %s removed", e.prefix)
+		}
+		defer e.requests.exit()
+		p.Context = contextWithCallName(p.Context, fmt.Sprint(p.Info.Path.AsArray()...))
+		return resolve(p)
+	}
+}
+
+// graphqlResult returns the result of a resolver, hiding the details of
+// internal errors.
+func graphqlResult(v interface{}, err error) (interface{}, error) {
+	return v, publicError(err)
+}
+
+// graphqlSchema returns the GraphQL schema of all services, building it if
+// services were added since it was last built.
+func (r *Router) graphqlSchema() (*graphql.Schema, error) {
+	r.graphqlMu.Lock()
+	defer r.graphqlMu.Unlock()
+
+	if r.graphql != nil {
+		return r.graphql, nil
+	}
+
+	var endpoints []*endpoint
+	for _, e := range r.endpointList() {
+		if e.parent == nil {
+			endpoints = append(endpoints, e)
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("Router has no services")
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].prefix < endpoints[j].prefix })
+
+	b := newGraphQLBuilder()
+	query := graphql.Fields{}
+	mutation := graphql.Fields{}
+	for _, e := range endpoints {
+		err := e.addGraphQLFields(b, query, mutation)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query:    graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: query}),
+		Mutation: graphql.NewObject(graphql.ObjectConfig{Name: "Mutation", Fields: mutation}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.graphql = &schema
+	return r.graphql, nil
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+func parseGraphQLRequest(req *http.Request) (*graphqlRequest, error) {
+	if req.Method == http.MethodGet {
+		q := req.URL.Query()
+		gqlReq := &graphqlRequest{
+			Query:         q.Get("query"),
+			OperationName: q.Get("operationName"),
+		}
+		if vars := q.Get("variables"); vars != "" {
+			err := json.Unmarshal([]byte(vars), &gqlReq.Variables)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return gqlReq, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/graphql") {
+		return &graphqlRequest{Query: string(body)}, nil
+	}
+	var gqlReq graphqlRequest
+	err = json.Unmarshal(body, &gqlReq)
+	if err != nil {
+		return nil, err
+	}
+	return &gqlReq, nil
+}
+
+// isMutation reports whether the operation the request selects is a
+// mutation.  If the document names no single operation to run, it reports
+// whether any operation is a mutation.  Documents that don't parse are left
+// to graphql.Do to report.
+func (gqlReq *graphqlRequest) isMutation() bool {
+	doc, err := parser.Parse(parser.ParseParams{Source: gqlReq.Query})
+	if err != nil {
+		return false
+	}
+
+	var ops []*ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		if op, ok := def.(*ast.OperationDefinition); ok {
+			ops = append(ops, op)
+		}
+	}
+	for _, op := range ops {
+		selected := len(ops) == 1 && gqlReq.OperationName == "" ||
+			op.Name != nil && op.Name.Value == gqlReq.OperationName
+		if selected {
+			return op.Operation == ast.OperationTypeMutation
+		}
+	}
+	for _, op := range ops {
+		if op.Operation == ast.OperationTypeMutation {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Router) serveGraphQL(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	schema, err := r.graphqlSchema()
+	if err != nil {
+		r.baseLogger().Error("GraphQL schema error", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	gqlReq, err := parseGraphQLRequest(req)
+	if err != nil {
+		http.Error(w, "Invalid GraphQL request", http.StatusBadRequest)
+		return
+	}
+	if req.Method == http.MethodGet && gqlReq.isMutation() {
+		http.Error(w, "Mutations require POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, _ := requestContext(w, req, r.baseLogger())
+	ctx, cancel := clientTimeoutContext(ctx, req, r.maxClientTimeout)
+	defer cancel()
+	ctx = contextWithTransportRequest(ctx, req)
+	result := graphql.Do(graphql.Params{
+		Schema:         *schema,
+		RequestString:  gqlReq.Query,
+		VariableValues: gqlReq.Variables,
+		OperationName:  gqlReq.OperationName,
+		Context:        ctx,
+	})
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		r.baseLogger().Error("Marshal error", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// GraphQLHandler returns an http.Handler serving a GraphQL API for every
+// service added to the router, usually mounted at "/graphql".  The schema is
+// derived from each service's data type.  For a service with prefix "users"
+// and data type *User it contains:
+//
+//	type Query {
+//	  users_get(id: Int!): User
+//	  users_query(args: [LazyQueryArg!], <field>: [String], ...): [User]
+//	}
+//	type Mutation {
+//	  users_new(data: UserInput!): Int
+//	  users_put(id: Int!, data: UserInput!): Int
+//	  users_delete(id: Int!): Int
+//	}
+//
+// Arguments of users_query are passed to the service's Query method as
+// url.Values.  There is one optional argument per scalar field of User, plus
+// args for arbitrary names.  If the router has tenants, requests are served
+// for their tenant.
+//
+// Each field goes through the service's middleware, limits and idempotency
+// keys as a request to the REST route of the operation carrying the headers
+// of the GraphQL request, e.g. a GET of /users/get/1 for users_get.  Fields
+// they reject fail with the message of the response.
+func (r *Router) GraphQLHandler() http.Handler {
+	return r.withTenant(withServiceScope(http.HandlerFunc(r.serveGraphQL)))
+}
+
+// resetGraphQL discards the GraphQL schema so that it is rebuilt with the
+// current services.
+func (r *Router) resetGraphQL() {
+	r.graphqlMu.Lock()
+	defer r.graphqlMu.Unlock()
+
+	r.graphql = nil
+}
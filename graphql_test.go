@@ -0,0 +1,158 @@
+package lazy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+type testGraphQLResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func testGraphQLReq(t *testing.T, addr string, query string, variables map[string]interface{}) *testGraphQLResponse {
+	body, _ := json.Marshal(map[string]interface{}{
+		"query":     query,
+		"variables": variables,
+	})
+	resp, b := testCodecReq(t, "POST", fmt.Sprintf("http://%s/graphql", addr),
+		"application/json", "", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %d from %s, got %d: %s", http.StatusOK, query, resp.StatusCode, string(b))
+	}
+
+	var ret testGraphQLResponse
+	err := json.Unmarshal(b, &ret)
+	if err != nil {
+		t.Fatalf("Can't decode response %s: %v", string(b), err)
+	}
+	return &ret
+}
+
+func testAndValidateGraphQLReq(t *testing.T, addr string, query string,
+	variables map[string]interface{}, field string, expected interface{}) {
+	ret := testGraphQLReq(t, addr, query, variables)
+	if len(ret.Errors) != 0 {
+		t.Errorf("Unexpected errors from %s: %v", query, ret.Errors)
+		return
+	}
+
+	b, _ := json.Marshal(expected)
+	if string(ret.Data[field]) != string(b) {
+		t.Errorf("Expected %s from %s, got %s", string(b), query, string(ret.Data[field]))
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	r := NewRouter()
+	s := NewTestService()
+	err := r.AddService("test", s)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/graphql", r.GraphQLHandler())
+	addr := startTestServer(t, mux)
+
+	testAndValidateGraphQLReq(t, addr, `mutation { test_new(data: {Name: "Test 1"}) }`,
+		nil, "test_new", 1)
+	testAndValidateGraphQLReq(t, addr, `mutation New($data: TestDataInput!) { test_new(data: $data) }`,
+		map[string]interface{}{"data": map[string]interface{}{"Name": "Test 2"}}, "test_new", 2)
+	testAndValidateGraphQLReq(t, addr, `{ test_get(id: 2) { ID Name } }`,
+		nil, "test_get", &TestData{ID: 2, Name: "Test 2"})
+	testAndValidateGraphQLReq(t, addr, `mutation { test_put(id: 1, data: {Name: "Test 1 put"}) }`,
+		nil, "test_put", 1)
+	testAndValidateGraphQLReq(t, addr,
+		`{ test_query(Name: "a", args: [{name: "tag", values: ["b", "c"]}]) { Name } }`,
+		nil, "test_query", []map[string]string{{"Name": "Test 1 put"}, {"Name": "Test 2"}})
+	expectedArgs := url.Values{"Name": {"a"}, "tag": {"b", "c"}}
+	if !reflect.DeepEqual(s.LastQueryArgs, expectedArgs) {
+		t.Errorf("Expected query args %v, got %v", expectedArgs, s.LastQueryArgs)
+	}
+	testAndValidateGraphQLReq(t, addr, `mutation { test_delete(id: 2) }`,
+		nil, "test_delete", 2)
+	if _, ok := s.data[2]; ok {
+		t.Errorf("Delete did not remove record")
+	}
+
+	ret := testGraphQLReq(t, addr, `{ test_get(id: 2) { ID } }`, nil)
+	if len(ret.Errors) == 0 {
+		t.Errorf("Expected error getting deleted record")
+	}
+
+	// Queries may also be sent with GET.
+	resp, b := testCodecReq(t, "GET", fmt.Sprintf("http://%s/graphql?query=%s", addr,
+		url.QueryEscape(`{ test_get(id: 1) { Name } }`)), "", "", nil)
+	if resp.StatusCode != http.StatusOK || string(b) != `{"data":{"test_get":{"Name":"Test 1 put"}}}` {
+		t.Errorf("Unexpected response to GET: %d %s", resp.StatusCode, string(b))
+	}
+
+	// Mutations are rejected over GET, however the document hides them.
+	for _, params := range []url.Values{
+		{"query": {`mutation { test_delete(id: 1) }`}},
+		{"query": {"# x\nmutation { test_delete(id: 1) }"}},
+		{"query": {`query Q { test_get(id: 1) { Name } } mutation M { test_delete(id: 1) }`},
+			"operationName": {"M"}},
+		{"query": {`query Q { test_get(id: 1) { Name } } mutation M { test_delete(id: 1) }`}},
+	} {
+		resp, b := testCodecReq(t, "GET", fmt.Sprintf("http://%s/graphql?%s", addr, params.Encode()),
+			"", "", nil)
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("Expected %d for mutation %v over GET, got %d %s",
+				http.StatusMethodNotAllowed, params, resp.StatusCode, string(b))
+		}
+	}
+	if _, ok := s.data[1]; !ok {
+		t.Errorf("Mutation over GET deleted record")
+	}
+	resp, b = testCodecReq(t, "GET", fmt.Sprintf("http://%s/graphql?%s", addr, url.Values{
+		"query":         {`query Q { test_get(id: 1) { Name } } mutation M { test_delete(id: 1) }`},
+		"operationName": {"Q"},
+	}.Encode()), "", "", nil)
+	if resp.StatusCode != http.StatusOK || string(b) != `{"data":{"test_get":{"Name":"Test 1 put"}}}` {
+		t.Errorf("Unexpected response to query operation over GET: %d %s", resp.StatusCode, string(b))
+	}
+
+	// Services added later are picked up.
+	err = r.AddService("other", NewTestService())
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	testAndValidateGraphQLReq(t, addr, `{ other_query { ID } }`, nil, "other_query", []interface{}{})
+}
+
+type graphqlNested struct {
+	Value int `json:"value"`
+}
+
+type GraphQLTestData struct {
+	graphqlNested
+	Name     string `json:"name"`
+	Skipped  string `json:"-"`
+	Children []*graphqlNested
+	private  int
+}
+
+func TestGraphQLFields(t *testing.T) {
+	var names []string
+	for _, f := range graphqlFields(reflect.TypeOf(GraphQLTestData{})) {
+		names = append(names, f.name)
+	}
+	expected := []string{"value", "name", "Children"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected fields %v, got %v", expected, names)
+	}
+
+	if name := graphqlName("my-service/v1"); name != "my_service_v1" {
+		t.Errorf("Unexpected GraphQL name %s", name)
+	}
+	if name := graphqlName("1st"); name != "_1st" {
+		t.Errorf("Unexpected GraphQL name %s", name)
+	}
+}
@@ -0,0 +1,293 @@
+package lazy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Operations of services with history.
+const (
+	OpHistory Operation = "history"
+	OpRevert  Operation = "revert"
+)
+
+// AsOfParam is the query parameter of Get requests to services with history
+// that reads the version of a record current at an RFC 3339 time, e.g.
+// "?as_of=2024-01-02T15:04:05Z".
+const AsOfParam = "as_of"
+
+var typeOfRecordVersions = reflect.TypeOf([]RecordVersion(nil))
+
+var errNoVersion = errors.New("version not found")
+
+// RecordVersion is a version of a record stored by a service with history.
+type RecordVersion struct {
+	// Number is the version number, starting at 1.
+	Number    int       `json:"number"`
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal,omitempty"`
+
+	// Data is the JSON encoding of the record, or null if Deleted.
+	Data json.RawMessage `json:"data"`
+
+	// Deleted is set on the version written when the record is deleted.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// HistoryStore stores the versions of records.  Stores must be safe for
+// concurrent use.  Services of routers with tenants pass prefixes qualified
+// with the tenant, e.g. "acme:users", and child services prefixes qualified
+// with their parent ids, e.g. "customers/orders?customers=1".
+type HistoryStore interface {
+	// Append stores v as the next version of record id of the service
+	// prefix and returns its number.  The Number of v is ignored.
+	Append(ctx context.Context, prefix string, id int, v RecordVersion) (int, error)
+
+	// Versions returns the versions of record id of the service prefix,
+	// oldest first.
+	Versions(ctx context.Context, prefix string, id int) ([]RecordVersion, error)
+}
+
+type historyKey struct {
+	prefix string
+	id     int
+}
+
+// MemoryHistoryStore is a HistoryStore keeping versions in memory.
+type MemoryHistoryStore struct {
+	mu       sync.Mutex
+	versions map[historyKey][]RecordVersion
+}
+
+// NewMemoryHistoryStore creates an empty MemoryHistoryStore.
+func NewMemoryHistoryStore() *MemoryHistoryStore {
+	return &MemoryHistoryStore{versions: make(map[historyKey][]RecordVersion)}
+}
+
+// Append implements the HistoryStore interface.
+func (s *MemoryHistoryStore) Append(ctx context.Context, prefix string, id int, v RecordVersion) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := historyKey{prefix, id}
+	v.Number = len(s.versions[key]) + 1
+	s.versions[key] = append(s.versions[key], v)
+	return v.Number, nil
+}
+
+// Versions implements the HistoryStore interface.
+func (s *MemoryHistoryStore) Versions(ctx context.Context, prefix string, id int) ([]RecordVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]RecordVersion{}, s.versions[historyKey{prefix, id}]...), nil
+}
+
+// WithHistory stores a version of a record in store every time it is
+// created, put or deleted.  If store is nil, versions are kept in memory.
+//
+// The service gains the routes {id}/history, which lists the versions of a
+// record, {id}/versions/{n}, which gets version n, and {id}/revert/{n}, which
+// puts version n as the next version.  Get requests with AsOfParam read the
+// version current at that time, and fail if the record was deleted then.
+func WithHistory(store HistoryStore) ServiceOption {
+	return func(e *endpoint) {
+		if store == nil {
+			store = NewMemoryHistoryStore()
+		}
+		e.history = store
+	}
+}
+
+// historyPrefix returns the prefix under which the versions of records read
+// or written with ctx are stored.
+func (e *endpoint) historyPrefix(ctx context.Context) string {
+	prefix := scopedPrefix(ctx, e.prefix)
+	if parents := parentKey(ctx); parents != "" {
+		prefix += "?" + parents
+	}
+	return prefix
+}
+
+// snapshot stores data as the next version of record id, or a deleted
+// version if data is nil.  Failures are logged, as the record has been
+// stored.
+func (e *endpoint) snapshot(ctx context.Context, id int, data interface{}) {
+	if e.history == nil {
+		return
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		logError(ctx, "History error", err)
+		return
+	}
+	v := RecordVersion{
+		Time:      time.Now().UTC(),
+		Principal: PrincipalFromContext(ctx),
+		Data:      b,
+		Deleted:   data == nil,
+	}
+	ctx = context.WithoutCancel(ctx)
+	afterCommit(ctx, func() {
+		_, err := e.history.Append(ctx, e.historyPrefix(ctx), id, v)
+		if err != nil {
+			logError(ctx, "History error", err)
+		}
+	})
+}
+
+// decodeVersion decodes the record stored in v.  Deleted versions have no
+// record.
+func (e *endpoint) decodeVersion(v *RecordVersion) (reflect.Value, error) {
+	if v.Deleted {
+		return reflect.Value{}, fmt.Errorf("version %d deleted the record: %w", v.Number, errNoVersion)
+	}
+	data := reflect.New(e.dataType.Elem())
+	err := json.Unmarshal(v.Data, data.Interface())
+	return data, err
+}
+
+// doGetVersion gets version n of record id.
+func (e *endpoint) doGetVersion(ctx context.Context, id int, n int) (reflect.Value, error) {
+	versions, err := e.history.Versions(ctx, e.historyPrefix(ctx), id)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if n < 1 || n > len(versions) {
+		return reflect.Value{}, fmt.Errorf("ID %d version %d: %w", id, n, errNoVersion)
+	}
+	data, err := e.decodeVersion(&versions[n-1])
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("ID %d: %w", id, err)
+	}
+	return data, nil
+}
+
+// doGetAsOf gets the version of record id current at t.
+func (e *endpoint) doGetAsOf(ctx context.Context, id int, t time.Time) (interface{}, error) {
+	versions, err := e.history.Versions(ctx, e.historyPrefix(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Time.After(t) {
+			continue
+		}
+		data, err := e.decodeVersion(&versions[i])
+		if err != nil {
+			return nil, fmt.Errorf("ID %d as of %v: %w", id, t, err)
+		}
+		if e.hidden(ctx, data) {
+			return nil, fmt.Errorf("ID %d: %w", id, errSoftDeleted)
+		}
+		return data.Interface(), nil
+	}
+	return nil, fmt.Errorf("ID %d as of %v: %w", id, t, errNoVersion)
+}
+
+// doRevert puts version n of record id as its next version.
+func (e *endpoint) doRevert(ctx context.Context, id int, n int) error {
+	data, err := e.doGetVersion(ctx, id, n)
+	if err != nil {
+		return err
+	}
+	return e.doPut(ctx, id, data)
+}
+
+// asOf returns the time in AsOfParam of r, or the zero time if r has none
+// or the service has no history.
+func (e *endpoint) asOf(r *http.Request) (time.Time, error) {
+	v := r.URL.Query().Get(AsOfParam)
+	if e.history == nil || v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// historyVars parses the id and version number in the path of r.
+func historyVars(r *http.Request) (id int, n int, err error) {
+	vars := mux.Vars(r)
+	id, err = strconv.Atoi(vars["id"])
+	if err == nil && vars["n"] != "" {
+		n, err = strconv.Atoi(vars["n"])
+	}
+	return id, n, err
+}
+
+func (e *endpoint) handleHistory(w http.ResponseWriter, r *http.Request) {
+	codec := e.codecs.responseCodec(r, typeOfRecordVersions)
+	if codec == nil {
+		http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+		return
+	}
+
+	id, _, err := historyVars(r)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	versions, err := e.history.Versions(r.Context(), e.historyPrefix(r.Context()), id)
+	if e.handleCallError(r, "History", err, w) {
+		return
+	}
+
+	e.sendResponse(w, r, codec, versions)
+}
+
+func (e *endpoint) handleVersion(w http.ResponseWriter, r *http.Request) {
+	codec := e.responseCodec(w, r)
+	if codec == nil {
+		return
+	}
+
+	id, n, err := historyVars(r)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	data, err := e.doGetVersion(r.Context(), id, n)
+	if e.handleCallError(r, "Version", err, w) {
+		return
+	}
+
+	e.sendResponse(w, r, codec, data.Interface())
+}
+
+func (e *endpoint) handleRevert(w http.ResponseWriter, r *http.Request) {
+	codec := e.responseCodec(w, r)
+	if codec == nil {
+		return
+	}
+
+	id, n, err := historyVars(r)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	err = e.doRevert(r.Context(), id, n)
+	if e.handleCallError(r, "Revert", err, w) {
+		return
+	}
+
+	e.sendResponse(w, r, codec, id)
+}
+
+// addHistoryRoutes adds the history, versions and revert routes.
+func (e *endpoint) addHistoryRoutes() {
+	if e.history == nil {
+		return
+	}
+	e.handle("/{id:[0-9]+}/history", e.serve(OpHistory, e.handleHistory))
+	e.handle("/{id:[0-9]+}/versions/{n:[0-9]+}", e.serve(OpHistory, e.handleVersion))
+	e.handle("/{id:[0-9]+}/revert/{n:[0-9]+}", e.serve(OpRevert, e.handleRevert))
+}
@@ -0,0 +1,167 @@
+package lazy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// OrdersTestService numbers the orders of every customer from 1.
+type OrdersTestService struct {
+	customers map[int]*TestService
+}
+
+func (s *OrdersTestService) orders(ctx context.Context) *TestService {
+	customer, _ := ParentID(ctx, "customers")
+	if s.customers[customer] == nil {
+		s.customers[customer] = NewTestService()
+	}
+	return s.customers[customer]
+}
+
+func (s *OrdersTestService) Get(ctx context.Context, id int) (*TestData, error) {
+	return s.orders(ctx).Get(ctx, id)
+}
+
+func (s *OrdersTestService) Put(ctx context.Context, id int, data *TestData) error {
+	return s.orders(ctx).Put(ctx, id, data)
+}
+
+func (s *OrdersTestService) New(ctx context.Context, data *TestData) (int, error) {
+	return s.orders(ctx).New(ctx, data)
+}
+
+func (s *OrdersTestService) Delete(ctx context.Context, id int) error {
+	return s.orders(ctx).Delete(ctx, id)
+}
+
+func (s *OrdersTestService) Query(ctx context.Context, args url.Values) ([]*TestData, error) {
+	return s.orders(ctx).Query(ctx, args)
+}
+
+func TestHistory(t *testing.T) {
+	r := NewRouter()
+	s := NewTestService()
+	err := r.AddService("test", s, WithHistory(nil))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+	base := fmt.Sprintf("http://%s/test", addr)
+
+	testVersionReq(t, "POST", base+"/new", nil, `{"Name": "One"}`, nil)
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	testVersionReq(t, "PUT", base+"/put/1", nil, `{"Name": "Two"}`, nil)
+
+	var versions []RecordVersion
+	resp := testVersionReq(t, "GET", base+"/1/history", nil, "", &versions)
+	if resp.StatusCode != http.StatusOK || len(versions) != 2 ||
+		versions[0].Number != 1 || string(versions[1].Data) != `{"ID":1,"Name":"Two"}` {
+		t.Fatalf("Unexpected history %d %+v", resp.StatusCode, versions)
+	}
+
+	var data TestData
+	resp = testVersionReq(t, "GET", base+"/1/versions/1", nil, "", &data)
+	if resp.StatusCode != http.StatusOK || data.Name != "One" {
+		t.Errorf("Expected version 1, got %d %+v", resp.StatusCode, data)
+	}
+	resp = testVersionReq(t, "GET", base+"/1/versions/3", nil, "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for missing version, got %d", resp.StatusCode)
+	}
+
+	asOf := url.QueryEscape(between.Format(time.RFC3339Nano))
+	resp = testVersionReq(t, "GET", base+"/get/1?as_of="+asOf, nil, "", &data)
+	if resp.StatusCode != http.StatusOK || data.Name != "One" {
+		t.Errorf("Expected version current as of %v, got %d %+v", between, resp.StatusCode, data)
+	}
+	resp = testVersionReq(t, "GET", base+"/get/1?as_of=2000-01-01T00:00:00Z", nil, "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 before the first version, got %d", resp.StatusCode)
+	}
+	resp = testVersionReq(t, "GET", base+"/get/1?as_of=now", nil, "", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid as_of, got %d", resp.StatusCode)
+	}
+
+	resp = testVersionReq(t, "GET", base+"/1/revert/1", nil, "", nil)
+	if resp.StatusCode != http.StatusOK || s.data[1].Name != "One" {
+		t.Errorf("Expected revert to version 1, got %d %+v", resp.StatusCode, s.data[1])
+	}
+	testVersionReq(t, "GET", base+"/1/history", nil, "", &versions)
+	if len(versions) != 3 || versions[2].Number != 3 {
+		t.Errorf("Expected revert to add a version, got %+v", versions)
+	}
+
+	// Deleting adds a deleted version, which is not current data.
+	time.Sleep(10 * time.Millisecond)
+	beforeDelete := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	testVersionReq(t, "GET", base+"/delete/1", nil, "", nil)
+	afterDelete := time.Now()
+	testVersionReq(t, "GET", base+"/1/history", nil, "", &versions)
+	if len(versions) != 4 || !versions[3].Deleted || string(versions[3].Data) != "null" {
+		t.Fatalf("Expected delete to add a deleted version, got %+v", versions)
+	}
+	asOf = url.QueryEscape(afterDelete.Format(time.RFC3339Nano))
+	resp = testVersionReq(t, "GET", base+"/get/1?as_of="+asOf, nil, "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 as of after the delete, got %d", resp.StatusCode)
+	}
+	asOf = url.QueryEscape(beforeDelete.Format(time.RFC3339Nano))
+	resp = testVersionReq(t, "GET", base+"/get/1?as_of="+asOf, nil, "", &data)
+	if resp.StatusCode != http.StatusOK || data.Name != "One" {
+		t.Errorf("Expected version current before the delete, got %d %+v", resp.StatusCode, data)
+	}
+	for _, path := range []string{"/1/versions/4", "/1/revert/4"} {
+		resp = testVersionReq(t, "GET", base+path, nil, "", nil)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestHistoryChildService(t *testing.T) {
+	r := NewRouter()
+	customers := NewTestService()
+	customers.New(context.Background(), &TestData{Name: "Customer 1"})
+	customers.New(context.Background(), &TestData{Name: "Customer 2"})
+	orders := &OrdersTestService{customers: map[int]*TestService{}}
+	if err := r.AddService("customers", customers); err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	if err := r.AddChildService("customers", "orders", orders, WithHistory(nil)); err != nil {
+		t.Fatalf("Can't add child service: %v", err)
+	}
+	addr := startTestServer(t, r)
+	base := func(customer int) string { return fmt.Sprintf("http://%s/customers/%d/orders", addr, customer) }
+
+	testVersionReq(t, "POST", base(1)+"/new", nil, `{"Name": "Order of 1"}`, nil)
+	testVersionReq(t, "POST", base(2)+"/new", nil, `{"Name": "Order of 2"}`, nil)
+
+	for customer, name := range map[int]string{1: "Order of 1", 2: "Order of 2"} {
+		var versions []RecordVersion
+		testVersionReq(t, "GET", base(customer)+"/1/history", nil, "", &versions)
+		if len(versions) != 1 || string(versions[0].Data) != fmt.Sprintf(`{"ID":1,"Name":%q}`, name) {
+			t.Errorf("Expected the history of customer %d only, got %+v", customer, versions)
+		}
+		var data TestData
+		asOf := url.QueryEscape(time.Now().Format(time.RFC3339Nano))
+		resp := testVersionReq(t, "GET", base(customer)+"/get/1?as_of="+asOf, nil, "", &data)
+		if resp.StatusCode != http.StatusOK || data.Name != name {
+			t.Errorf("Expected %s as of now, got %d %+v", name, resp.StatusCode, data)
+		}
+	}
+
+	// Reverting takes the version from the record's own history.
+	testVersionReq(t, "PUT", base(2)+"/put/1", nil, `{"Name": "Changed"}`, nil)
+	resp := testVersionReq(t, "GET", base(2)+"/1/revert/1", nil, "", nil)
+	if resp.StatusCode != http.StatusOK || orders.customers[2].data[1].Name != "Order of 2" {
+		t.Errorf("Expected revert to customer 2's version, got %d %+v", resp.StatusCode, orders.customers[2].data[1])
+	}
+}
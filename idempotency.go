@@ -0,0 +1,237 @@
+package lazy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader is the header in which clients send the key that
+// identifies retries of the same New, Put or Delete request.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader is set to "true" on responses replayed from an
+// IdempotencyStore.
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// DefaultIdempotencyTTL is how long the default store keeps responses.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLen is the length of the longest key clients may send.
+const maxIdempotencyKeyLen = 255
+
+// idempotencySweepInterval is how often a MemoryIdempotencyStore drops
+// expired records.
+const idempotencySweepInterval = time.Minute
+
+// IdempotencyRecord is a response stored under an idempotency key.
+type IdempotencyRecord struct {
+	// Fingerprint identifies the request the response belongs to.
+	// Requests with the same key but a different fingerprint are rejected.
+	Fingerprint string
+
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// IdempotencyStore stores the responses to requests carrying an idempotency
+// key.  Stores must be safe for concurrent use.
+type IdempotencyStore interface {
+	// Get returns the record stored under key, or nil if there is none.
+	Get(ctx context.Context, key string) (*IdempotencyRecord, error)
+
+	// Put stores rec under key.
+	Put(ctx context.Context, key string, rec *IdempotencyRecord) error
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore keeping records in memory
+// for a fixed time.
+type MemoryIdempotencyStore struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu        sync.Mutex
+	records   map[string]memoryIdempotencyEntry
+	lastSweep time.Time
+}
+
+type memoryIdempotencyEntry struct {
+	rec     *IdempotencyRecord
+	expires time.Time
+}
+
+// NewMemoryIdempotencyStore creates a MemoryIdempotencyStore keeping records
+// for ttl.
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		ttl:     ttl,
+		now:     time.Now,
+		records: make(map[string]memoryIdempotencyEntry),
+	}
+}
+
+// Get returns the record stored under key, or nil if there is none or it
+// has expired.
+func (s *MemoryIdempotencyStore) Get(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.records[key]
+	if !ok {
+		return nil, nil
+	}
+	if !s.now().Before(entry.expires) {
+		delete(s.records, key)
+		return nil, nil
+	}
+	return entry.rec, nil
+}
+
+// Put stores rec under key.
+func (s *MemoryIdempotencyStore) Put(ctx context.Context, key string, rec *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) >= idempotencySweepInterval {
+		s.sweep(now)
+	}
+	s.records[key] = memoryIdempotencyEntry{rec: rec, expires: now.Add(s.ttl)}
+	return nil
+}
+
+// sweep drops expired records.
+func (s *MemoryIdempotencyStore) sweep(now time.Time) {
+	for k, entry := range s.records {
+		if !now.Before(entry.expires) {
+			delete(s.records, k)
+		}
+	}
+	s.lastSweep = now
+}
+
+// WithIdempotency makes New, Put and Delete requests of the service carrying
+// an IdempotencyKeyHeader idempotent.  The first response to a key is stored
+// in store and replayed for retries with the same key and request.  A request
+// reusing a key with a different payload is rejected with 422 Unprocessable
+// Entity.  Server errors are not stored, so requests failing with them can be
+// retried.
+//
+// If store is nil, responses are kept in memory for DefaultIdempotencyTTL.
+func WithIdempotency(store IdempotencyStore) ServiceOption {
+	return func(e *endpoint) {
+		if store == nil {
+			store = NewMemoryIdempotencyStore(DefaultIdempotencyTTL)
+		}
+		e.idempotencyStore = store
+	}
+}
+
+// idempotencyFingerprint identifies a request by its method, path and body.
+// Operations requested over JSON-RPC and GraphQL are told apart from REST
+// requests, as their responses differ.
+func idempotencyFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	if isCall(r) {
+		h.Write([]byte("call\n"))
+	}
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// captureWriter keeps a copy of the response it writes.
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// idempotent wraps h, the handler of op, with idempotency key handling.
+func (e *endpoint) idempotent(op Operation, h http.Handler) http.Handler {
+	if e.idempotencyStore == nil || op == OpGet || op == OpQuery {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			e.sendError(w, r, http.StatusBadRequest, "Invalid "+IdempotencyKeyHeader)
+			return
+		}
+		storeKey := scopedPrefix(r.Context(), e.prefix) + ":" + key
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logError(r.Context(), "Read error", err)
+			e.sendError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := idempotencyFingerprint(r, body)
+
+		// Concurrent requests with the same key are not run together.
+		if _, busy := e.idempotencyInFlight.LoadOrStore(storeKey, struct{}{}); busy {
+			e.sendError(w, r, http.StatusConflict, "Request with the same "+IdempotencyKeyHeader+" in progress")
+			return
+		}
+		defer e.idempotencyInFlight.Delete(storeKey)
+
+		rec, err := e.idempotencyStore.Get(r.Context(), storeKey)
+		if err != nil {
+			logError(r.Context(), "Idempotency store error", err)
+			e.sendError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		if rec != nil {
+			if rec.Fingerprint != fingerprint {
+				e.sendError(w, r, http.StatusUnprocessableEntity,
+					IdempotencyKeyHeader+" was used for a different request")
+				return
+			}
+			if rec.ContentType != "" {
+				w.Header().Set("Content-Type", rec.ContentType)
+			}
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			w.WriteHeader(rec.Status)
+			w.Write(rec.Body)
+			return
+		}
+
+		cw := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(cw, r)
+		if cw.status >= http.StatusInternalServerError {
+			return
+		}
+
+		err = e.idempotencyStore.Put(r.Context(), storeKey, &IdempotencyRecord{
+			Fingerprint: fingerprint,
+			Status:      cw.status,
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        cw.body.Bytes(),
+		})
+		if err != nil {
+			logError(r.Context(), "Idempotency store error", err)
+		}
+	})
+}
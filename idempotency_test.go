@@ -0,0 +1,131 @@
+package lazy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testIdempotentReq(t *testing.T, addr string, path string, key string, body string) (*http.Response, string) {
+	req, _ := http.NewRequest("POST", fmt.Sprintf("http://%s%s", addr, path), strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Post error: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Read error: %v", err)
+	}
+	return resp, string(b)
+}
+
+func TestIdempotency(t *testing.T) {
+	r := NewRouter()
+	s := NewTestService()
+	err := r.AddService("test", s, WithIdempotency(nil))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	resp, first := testIdempotentReq(t, addr, "/test/new", "key-1", `{"name": "Test 1"}`)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(IdempotentReplayedHeader) != "" {
+		t.Fatalf("Unexpected first response %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// A retry is replayed without creating another record.
+	resp, replay := testIdempotentReq(t, addr, "/test/new", "key-1", `{"name": "Test 1"}`)
+	if resp.StatusCode != http.StatusOK || replay != first {
+		t.Errorf("Expected replay of %q, got %d %q", first, resp.StatusCode, replay)
+	}
+	if resp.Header.Get(IdempotentReplayedHeader) != "true" {
+		t.Errorf("Expected replayed response to be marked")
+	}
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected replayed content type, got %q", resp.Header.Get("Content-Type"))
+	}
+	if len(s.data) != 1 {
+		t.Errorf("Expected 1 record, got %d", len(s.data))
+	}
+
+	// Reusing a key for a different request is rejected.
+	resp, body := testIdempotentReq(t, addr, "/test/new", "key-1", `{"name": "Test 2"}`)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for conflicting payload, got %d", resp.StatusCode)
+	}
+	var errResp Response
+	if json.Unmarshal([]byte(body), &errResp) != nil || errResp.Error == "" {
+		t.Errorf("Expected error envelope, got %q", body)
+	}
+	resp, _ = testIdempotentReq(t, addr, "/test/put/1", "key-1", `{"name": "Test 1"}`)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for key reused on another path, got %d", resp.StatusCode)
+	}
+
+	// Requests without a key or with other keys are not deduplicated.
+	testIdempotentReq(t, addr, "/test/new", "", `{"name": "Test 1"}`)
+	testIdempotentReq(t, addr, "/test/new", "key-2", `{"name": "Test 1"}`)
+	if len(s.data) != 3 {
+		t.Errorf("Expected 3 records, got %d", len(s.data))
+	}
+
+	// Server errors are not stored.
+	s.FailNew = true
+	resp, _ = testIdempotentReq(t, addr, "/test/new", "key-3", `{"name": "Test 4"}`)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Expected failed New, got %d", resp.StatusCode)
+	}
+	s.FailNew = false
+	resp, _ = testIdempotentReq(t, addr, "/test/new", "key-3", `{"name": "Test 4"}`)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(IdempotentReplayedHeader) != "" {
+		t.Errorf("Expected retry after server error to run, got %d", resp.StatusCode)
+	}
+
+	resp, _ = testIdempotentReq(t, addr, "/test/new", strings.Repeat("k", 256), `{}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for overlong key, got %d", resp.StatusCode)
+	}
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	s := NewMemoryIdempotencyStore(time.Minute)
+	s.now = func() time.Time { return now }
+
+	rec := &IdempotencyRecord{Fingerprint: "f", Status: http.StatusOK}
+	s.Put(ctx, "a", rec)
+	if got, _ := s.Get(ctx, "a"); got != rec {
+		t.Errorf("Expected stored record, got %v", got)
+	}
+	s.Put(ctx, "b", rec)
+
+	// Expired records are dropped at most once per sweep interval.
+	now = now.Add(30 * time.Second)
+	s.Put(ctx, "c", rec)
+	if len(s.records) != 3 {
+		t.Errorf("Expected no sweep within the interval, got %v", s.records)
+	}
+
+	now = now.Add(30 * time.Second)
+	if got, _ := s.Get(ctx, "a"); got != nil {
+		t.Errorf("Expected expired record to be gone, got %v", got)
+	}
+	if _, ok := s.records["a"]; ok {
+		t.Errorf("Expected expired record to be dropped when read, got %v", s.records)
+	}
+	s.Put(ctx, "d", rec)
+	if _, ok := s.records["b"]; ok || len(s.records) != 2 {
+		t.Errorf("Expected expired records to be swept, got %v", s.records)
+	}
+}
@@ -0,0 +1,145 @@
+package lazy
+
+import (
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+)
+
+// ServicesPath is the path at which WithIntrospection serves the services of
+// a router.
+const ServicesPath = "/_lazy/services"
+
+var typeOfServiceInfos = reflect.TypeOf([]ServiceInfo(nil))
+
+// ServiceInfo describes a service added to a Router.
+type ServiceInfo struct {
+	Prefix     string      `json:"prefix"`
+	Operations []Operation `json:"operations"`
+
+	// Path is the path template below which the service's routes live.
+	Path string `json:"path"`
+
+	// Parent is the prefix of the parent service of a child service.
+	Parent string `json:"parent,omitempty"`
+
+	// Version is the version of a versioned service, which is part of its
+	// prefix.
+	Version string `json:"version,omitempty"`
+
+	// Deprecated is set if the service announces its deprecation.
+	Deprecated bool `json:"deprecated,omitempty"`
+
+	// IDType is the Go type of record ids.
+	IDType string `json:"idType"`
+
+	// DataType describes the type of the records the service stores.
+	DataType *TypeInfo `json:"dataType"`
+
+	// Middleware lists the names of the functions wrapping the service's
+	// handlers, outermost first.
+	Middleware []string `json:"middleware"`
+
+	// Actions describes the operations of the service beyond the CRUD
+	// operations, ordered by name.
+	Actions []ActionInfo `json:"actions,omitempty"`
+}
+
+// ActionInfo describes a custom action of a service.
+type ActionInfo struct {
+	Name string `json:"name"`
+
+	// Record is true for actions on a single record.
+	Record bool `json:"record"`
+
+	// Input describes the request body, or is named "url.Values" if the
+	// action takes the query arguments.  It is nil if the action takes no
+	// input.
+	Input *TypeInfo `json:"input,omitempty"`
+
+	// Output describes the result.  It is nil if the action has none.
+	Output *TypeInfo `json:"output,omitempty"`
+}
+
+func funcName(f interface{}) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer())
+	if fn == nil {
+		return "unknown"
+	}
+	return fn.Name()
+}
+
+func (e *endpoint) operations() []Operation {
+	ops := []Operation{OpGet, OpPut, OpNew, OpDelete, OpQuery}
+	if e.softDelete != nil {
+		ops = append(ops, OpTrash, OpRestore, OpPurge)
+	}
+	if e.auditSink != nil {
+		ops = append(ops, OpAudit)
+	}
+	if e.history != nil {
+		ops = append(ops, OpHistory, OpRevert)
+	}
+	return ops
+}
+
+func (e *endpoint) info() ServiceInfo {
+	info := ServiceInfo{
+		Prefix:     e.prefix,
+		Operations: e.operations(),
+		Path:       e.path(),
+		Version:    e.version,
+		Deprecated: e.deprecation != nil,
+		IDType:     e.get.Type.In(2).String(),
+		DataType:   DescribeType(e.dataType),
+		Middleware: []string{},
+	}
+	if e.parent != nil {
+		info.Parent = e.parent.prefix
+	}
+	for _, mw := range e.middleware {
+		info.Middleware = append(info.Middleware, funcName(mw))
+	}
+	for _, a := range e.sortedActions() {
+		ai := ActionInfo{Name: a.name, Record: a.record}
+		if a.in != nil {
+			ai.Input = DescribeType(a.in)
+		}
+		if a.out != nil {
+			ai.Output = DescribeType(a.out)
+		}
+		info.Actions = append(info.Actions, ai)
+	}
+	return info
+}
+
+// Services describes the services added to the router, ordered by prefix.
+func (r *Router) Services() []ServiceInfo {
+	var services []ServiceInfo
+	for _, e := range r.endpointList() {
+		services = append(services, e.info())
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Prefix < services[j].Prefix })
+	return services
+}
+
+func (r *Router) handleServices(w http.ResponseWriter, req *http.Request) {
+	codec := r.codecs.responseCodec(req, typeOfServiceInfos)
+	if codec == nil {
+		http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+		return
+	}
+
+	err := sendResponse(w, codec, r.Services())
+	if err != nil {
+		r.baseLogger().Error("Marshal error", "error", err)
+	}
+}
+
+// WithIntrospection serves the result of Router.Services at ServicesPath.
+func WithIntrospection() RouterOption {
+	return func(r *Router) {
+		r.router.HandleFunc(ServicesPath, r.handleServices)
+	}
+}
@@ -0,0 +1,127 @@
+package lazy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type introspectNode struct {
+	Label    string
+	Children []*introspectNode
+}
+
+type IntrospectTestData struct {
+	ID      int `json:"id"`
+	Tags    []string
+	Created time.Time
+	Root    *introspectNode
+	Skipped string `json:"-"`
+}
+
+func testMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test-Middleware", "1")
+		h.ServeHTTP(w, r)
+	})
+}
+
+func TestServices(t *testing.T) {
+	r := NewRouter(WithIntrospection())
+	err := r.AddService("test", NewTestService(), WithMiddleware(testMiddleware))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	err = r.AddService("proto", NewProtoTestService())
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+
+	services := r.Services()
+	if len(services) != 2 || services[0].Prefix != "proto" || services[1].Prefix != "test" {
+		t.Fatalf("Unexpected services %v", services)
+	}
+
+	info := services[1]
+	expectedOps := []Operation{OpGet, OpPut, OpNew, OpDelete, OpQuery}
+	if !reflect.DeepEqual(info.Operations, expectedOps) {
+		t.Errorf("Expected operations %v, got %v", expectedOps, info.Operations)
+	}
+	if info.IDType != "int" {
+		t.Errorf("Expected id type int, got %s", info.IDType)
+	}
+	expectedType := &TypeInfo{
+		Name: "lazy.TestData",
+		Kind: KindObject,
+		Fields: []FieldInfo{
+			{Name: "ID", Type: &TypeInfo{Name: "int", Kind: KindInteger}},
+			{Name: "Name", Type: &TypeInfo{Name: "string", Kind: KindString}},
+		},
+	}
+	if !reflect.DeepEqual(info.DataType, expectedType) {
+		t.Errorf("Expected data type %+v, got %+v", expectedType, info.DataType)
+	}
+	if len(info.Middleware) != 1 || !strings.HasSuffix(info.Middleware[0], ".testMiddleware") {
+		t.Errorf("Unexpected middleware %v", info.Middleware)
+	}
+
+	addr := startTestServer(t, r)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/test/query", addr))
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	if resp.Header.Get("X-Test-Middleware") != "1" {
+		t.Errorf("Middleware not applied")
+	}
+
+	resp, err = http.Get(fmt.Sprintf("http://%s%s", addr, ServicesPath))
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	var ret struct {
+		Data []ServiceInfo `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&ret)
+	if err != nil {
+		t.Fatalf("JSON decode error: %v", err)
+	}
+	if !reflect.DeepEqual(ret.Data, services) {
+		t.Errorf("Expected %+v from %s, got %+v", services, ServicesPath, ret.Data)
+	}
+}
+
+func TestServicesRouteOptional(t *testing.T) {
+	r := NewRouter()
+	addr := startTestServer(t, r)
+	testBadGet(t, addr, ServicesPath)
+}
+
+func TestDescribeType(t *testing.T) {
+	info := DescribeType(reflect.TypeOf(&IntrospectTestData{}))
+
+	var names []string
+	for _, f := range info.Fields {
+		names = append(names, f.Name+":"+f.Type.Kind)
+	}
+	expected := []string{"id:integer", "Tags:array", "Created:string", "Root:object"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected fields %v, got %v", expected, names)
+	}
+
+	if info.Fields[1].Type.Elem.Kind != KindString {
+		t.Errorf("Expected string elements, got %v", info.Fields[1].Type.Elem)
+	}
+
+	// Recursive types are only expanded once.
+	root := info.Fields[3].Type
+	children := root.Fields[1].Type
+	if children.Kind != KindArray || children.Elem.Name != "lazy.introspectNode" ||
+		len(children.Elem.Fields) != 0 {
+		t.Errorf("Unexpected recursive type description %+v", children.Elem)
+	}
+}
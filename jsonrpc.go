@@ -0,0 +1,399 @@
+package lazy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+
+	// rpcServiceError is reported when a service method returns an error.
+	rpcServiceError = -32000
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+
+	// ID is empty for notifications.  A null id is kept as "null".
+	ID json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+func newRPCError(code int, format string, a ...interface{}) *rpcError {
+	return &rpcError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// rpcParams extracts the parameters called names from params, which may be
+// either an array of positional parameters or an object of named ones.
+// Missing parameters are returned as nil.
+func rpcParams(params json.RawMessage, names ...string) ([]json.RawMessage, *rpcError) {
+	values := make([]json.RawMessage, len(names))
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		return values, nil
+	}
+
+	switch params[0] {
+	case '[':
+		var positional []json.RawMessage
+		err := json.Unmarshal(params, &positional)
+		if err != nil {
+			return nil, newRPCError(rpcInvalidParams, "Invalid params: %v", err)
+		}
+		if len(positional) > len(names) {
+			return nil, newRPCError(rpcInvalidParams, "Expected at most %d params, got %d",
+				len(names), len(positional))
+		}
+		copy(values, positional)
+	case '{':
+		var named map[string]json.RawMessage
+		err := json.Unmarshal(params, &named)
+		if err != nil {
+			return nil, newRPCError(rpcInvalidParams, "Invalid params: %v", err)
+		}
+		for i, name := range names {
+			values[i] = named[name]
+		}
+	default:
+		return nil, newRPCError(rpcInvalidParams, "Params must be an array or object")
+	}
+	return values, nil
+}
+
+func rpcID(param json.RawMessage) (int, *rpcError) {
+	var id int
+	if param == nil {
+		return 0, newRPCError(rpcInvalidParams, "Missing id param")
+	}
+	err := json.Unmarshal(param, &id)
+	if err != nil {
+		return 0, newRPCError(rpcInvalidParams, "Invalid id: %v", err)
+	}
+	return id, nil
+}
+
+func (e *endpoint) rpcData(param json.RawMessage) (reflect.Value, *rpcError) {
+	data := reflect.New(e.dataType.Elem())
+	if param == nil {
+		return data, newRPCError(rpcInvalidParams, "Missing data param")
+	}
+	err := json.Unmarshal(param, data.Interface())
+	if err != nil {
+		return data, newRPCError(rpcInvalidParams, "Invalid data: %v", err)
+	}
+	return data, nil
+}
+
+// rpcQueryArgs converts query params to url.Values.  Params are either an
+// object whose members are strings or arrays of strings, or a single
+// positional object of the same form.
+func rpcQueryArgs(params json.RawMessage) (url.Values, *rpcError) {
+	params = bytes.TrimSpace(params)
+	if len(params) > 0 && params[0] == '[' {
+		values, rpcErr := rpcParams(params, "args")
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		params = values[0]
+	}
+
+	args := url.Values{}
+	if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		return args, nil
+	}
+
+	var named map[string]json.RawMessage
+	err := json.Unmarshal(params, &named)
+	if err != nil {
+		return nil, newRPCError(rpcInvalidParams, "Query params must be an object: %v", err)
+	}
+	for name, raw := range named {
+		var value string
+		if json.Unmarshal(raw, &value) == nil {
+			args.Add(name, value)
+			continue
+		}
+		var values []string
+		err = json.Unmarshal(raw, &values)
+		if err != nil {
+			return nil, newRPCError(rpcInvalidParams,
+				"Query param %s must be a string or array of strings", name)
+		}
+		args[name] = append(args[name], values...)
+	}
+	return args, nil
+}
+
+// rpcCall performs a single operation named by method, which has the form
+// "<prefix>.<operation>".
+func (r *Router) rpcCall(ctx context.Context, method string, params json.RawMessage) (interface{}, *rpcError) {
+	i := strings.LastIndex(method, ".")
+	if i < 0 {
+		return nil, newRPCError(rpcMethodNotFound, "Method %s not found", method)
+	}
+	e, ok := r.endpoint(method[:i])
+	if !ok || e.parent != nil || !e.requests.enter() {
+		return nil, newRPCError(rpcMethodNotFound, "Method %s not found", method)
+	}
+	defer e.requests.exit()
+
+	var result interface{}
+	var err error
+	switch Operation(method[i+1:]) {
+	case OpGet:
+		values, rpcErr := rpcParams(params, "id")
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		id, rpcErr := rpcID(values[0])
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		result, err = e.operate(ctx, OpGet, id, nil, nil, func(ctx context.Context) (interface{}, error) {
+			return e.doGet(ctx, id)
+		})
+
+	case OpPut:
+		values, rpcErr := rpcParams(params, "id", "data")
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		id, rpcErr := rpcID(values[0])
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		data, rpcErr := e.rpcData(values[1])
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		result, err = e.operate(ctx, OpPut, id, nil, data.Interface(), func(ctx context.Context) (interface{}, error) {
+			return id, e.doPut(ctx, id, data)
+		})
+
+	case OpNew:
+		values, rpcErr := rpcParams(params, "data")
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		data, rpcErr := e.rpcData(values[0])
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		result, err = e.operate(ctx, OpNew, 0, nil, data.Interface(), func(ctx context.Context) (interface{}, error) {
+			return e.doNew(ctx, data)
+		})
+
+	case OpDelete:
+		values, rpcErr := rpcParams(params, "id")
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		id, rpcErr := rpcID(values[0])
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		result, err = e.operate(ctx, OpDelete, id, nil, nil, func(ctx context.Context) (interface{}, error) {
+			return id, e.doDelete(ctx, id)
+		})
+
+	case OpQuery:
+		args, rpcErr := rpcQueryArgs(params)
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		result, err = e.operate(ctx, OpQuery, 0, args, nil, func(ctx context.Context) (interface{}, error) {
+			return e.doQuery(ctx, args)
+		})
+
+	default:
+		return nil, newRPCError(rpcMethodNotFound, "Method %s not found", method)
+	}
+
+	if err != nil {
+		if publicError(err) != err || err == errInternal {
+			return nil, newRPCError(rpcInternalError, "%v", publicError(err))
+		}
+		return nil, newRPCError(rpcServiceError, "%v", err)
+	}
+	return result, nil
+}
+
+// handleRPC handles a single JSON-RPC request object.  It reports whether
+// the request is a notification, whose response must not be sent.
+func (r *Router) handleRPC(ctx context.Context, raw json.RawMessage) (*rpcResponse, bool) {
+	var req rpcRequest
+	err := json.Unmarshal(raw, &req)
+	if err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+		return &rpcResponse{
+			JSONRPC: "2.0",
+			Error:   newRPCError(rpcInvalidRequest, "Invalid Request"),
+		}, false
+	}
+
+	result, rpcErr := r.rpcCall(ctx, req.Method, req.Params)
+	resp := &rpcResponse{
+		JSONRPC: "2.0",
+		Error:   rpcErr,
+		ID:      req.ID,
+	}
+	if rpcErr == nil {
+		resp.Result, err = json.Marshal(result)
+		if err != nil {
+			r.baseLogger().Error("Marshal error", "error", err)
+			resp.Error = newRPCError(rpcInternalError, "Internal error")
+		}
+	}
+	return resp, len(req.ID) == 0
+}
+
+// handleRPCBatch handles the request objects of a batch, in a transaction if
+// the router has a batch transactor.  It returns the responses to send.
+func (r *Router) handleRPCBatch(ctx context.Context, batch []json.RawMessage) []*rpcResponse {
+	var all, responses []*rpcResponse
+	err := inTransaction(ctx, r.batchTransactor, func(ctx context.Context) error {
+		var failed error
+		for i, raw := range batch {
+			resp, notification := r.handleRPC(contextWithCallName(ctx, strconv.Itoa(i)), raw)
+			if resp.Error != nil {
+				failed = errors.New("a call of the batch failed")
+			}
+			all = append(all, resp)
+			if !notification {
+				responses = append(responses, resp)
+			}
+		}
+		return failed
+	})
+	if err == nil || r.batchTransactor == nil {
+		return responses
+	}
+
+	if all == nil {
+		// The transaction could not be begun.
+		logError(ctx, "Batch error", err)
+		return []*rpcResponse{{JSONRPC: "2.0", Error: newRPCError(rpcInternalError, "Internal error")}}
+	}
+	for _, resp := range all {
+		if resp.Error == nil {
+			resp.Result = nil
+			resp.Error = newRPCError(rpcServiceError, "Batch rolled back: %v", err)
+		}
+	}
+	return responses
+}
+
+func (r *Router) sendRPCResponse(w http.ResponseWriter, resp interface{}) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		r.baseLogger().Error("Marshal error", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (r *Router) serveJSONRPC(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		r.baseLogger().Error("Read error", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	ctx, _ := requestContext(w, req, r.baseLogger())
+	ctx, cancel := clientTimeoutContext(ctx, req, r.maxClientTimeout)
+	defer cancel()
+	ctx = contextWithTransportRequest(ctx, req)
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		err = json.Unmarshal(body, &batch)
+		if err == nil {
+			if len(batch) == 0 {
+				r.sendRPCResponse(w, &rpcResponse{
+					JSONRPC: "2.0",
+					Error:   newRPCError(rpcInvalidRequest, "Invalid Request"),
+				})
+				return
+			}
+
+			responses := r.handleRPCBatch(ctx, batch)
+			if len(responses) == 0 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			r.sendRPCResponse(w, responses)
+			return
+		}
+	} else if json.Valid(body) {
+		resp, notification := r.handleRPC(ctx, body)
+		if notification {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		r.sendRPCResponse(w, resp)
+		return
+	}
+
+	r.sendRPCResponse(w, &rpcResponse{
+		JSONRPC: "2.0",
+		Error:   newRPCError(rpcParseError, "Parse error"),
+	})
+}
+
+// JSONRPCHandler returns an http.Handler exposing every service added to the
+// router over JSON-RPC 2.0.  Each service operation is available as a method
+// named "<prefix>.<operation>", e.g. "users.get", with these params:
+//
+//	get:    {"id": 1}                 or [1]
+//	put:    {"id": 1, "data": {...}}  or [1, {...}]
+//	new:    {"data": {...}}           or [{...}]
+//	delete: {"id": 1}                 or [1]
+//	query:  {"name": "value", ...}    or [{"name": ["value", ...]}]
+//
+// Batches and notifications are supported.  Errors returned by services are
+// reported with code -32000.  Each call goes through the service's
+// middleware, limits and idempotency keys as a request to the REST route of
+// the operation carrying the headers of the JSON-RPC request, e.g. a GET of
+// /users/get/1 for "users.get".  Calls they reject are reported with code
+// -32000 and the message of the response.  If the router has tenants,
+// requests are served for their tenant.
+func (r *Router) JSONRPCHandler() http.Handler {
+	return r.withTenant(withServiceScope(http.HandlerFunc(r.serveJSONRPC)))
+}
@@ -0,0 +1,152 @@
+package lazy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result"`
+	Error   *rpcError       `json:"error"`
+	ID      json.RawMessage `json:"id"`
+}
+
+func testRPCReq(t *testing.T, addr string, body string) (int, []byte) {
+	resp, b := testCodecReq(t, "POST", fmt.Sprintf("http://%s/rpc", addr),
+		"application/json", "", []byte(body))
+	return resp.StatusCode, b
+}
+
+func testAndDecodeRPCReq(t *testing.T, addr string, body string) *testRPCResponse {
+	status, b := testRPCReq(t, addr, body)
+	if status != http.StatusOK {
+		t.Fatalf("Expected %d from %s, got %d", http.StatusOK, body, status)
+	}
+	var resp testRPCResponse
+	err := json.Unmarshal(b, &resp)
+	if err != nil {
+		t.Fatalf("Can't decode response %s: %v", string(b), err)
+	}
+	return &resp
+}
+
+func testAndValidateRPCResult(t *testing.T, addr string, body string, result interface{}) {
+	resp := testAndDecodeRPCReq(t, addr, body)
+	if resp.Error != nil {
+		t.Errorf("Unexpected error from %s: %v", body, resp.Error)
+		return
+	}
+	expected, _ := json.Marshal(result)
+	if string(resp.Result) != string(expected) {
+		t.Errorf("Expected result %s from %s, got %s", string(expected), body, string(resp.Result))
+	}
+}
+
+func testAndValidateRPCError(t *testing.T, addr string, body string, code int) {
+	resp := testAndDecodeRPCReq(t, addr, body)
+	if resp.Error == nil || resp.Error.Code != code {
+		t.Errorf("Expected error code %d from %s, got %v", code, body, resp.Error)
+	}
+}
+
+func TestJSONRPC(t *testing.T) {
+	r := NewRouter()
+	s := NewTestService()
+	err := r.AddService("test", s)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", r.JSONRPCHandler())
+	addr := startTestServer(t, mux)
+
+	testAndValidateRPCResult(t, addr,
+		`{"jsonrpc": "2.0", "method": "test.new", "params": {"data": {"Name": "Test 1"}}, "id": 1}`, 1)
+	testAndValidateRPCResult(t, addr,
+		`{"jsonrpc": "2.0", "method": "test.new", "params": [{"Name": "Test 2"}], "id": 2}`, 2)
+	testAndValidateRPCResult(t, addr,
+		`{"jsonrpc": "2.0", "method": "test.get", "params": [2], "id": 3}`,
+		&TestData{ID: 2, Name: "Test 2"})
+	testAndValidateRPCResult(t, addr,
+		`{"jsonrpc": "2.0", "method": "test.put", "params": {"id": 1, "data": {"Name": "Test 1 put"}}, "id": 4}`, 1)
+	testAndValidateRPCResult(t, addr,
+		`{"jsonrpc": "2.0", "method": "test.query", "params": {"name": "a", "tag": ["b", "c"]}, "id": 5}`,
+		[]*TestData{{ID: 1, Name: "Test 1 put"}, {ID: 2, Name: "Test 2"}})
+	expectedArgs := map[string][]string{"name": {"a"}, "tag": {"b", "c"}}
+	if !reflect.DeepEqual(map[string][]string(s.LastQueryArgs), expectedArgs) {
+		t.Errorf("Expected query args %v, got %v", expectedArgs, s.LastQueryArgs)
+	}
+	testAndValidateRPCResult(t, addr,
+		`{"jsonrpc": "2.0", "method": "test.delete", "params": {"id": 2}, "id": 6}`, 2)
+	if _, ok := s.data[2]; ok {
+		t.Errorf("Delete did not remove record")
+	}
+
+	testAndValidateRPCError(t, addr,
+		`{"jsonrpc": "2.0", "method": "test.get", "params": [2], "id": 7}`, rpcServiceError)
+	testAndValidateRPCError(t, addr,
+		`{"jsonrpc": "2.0", "method": "test.get", "params": ["word"], "id": 8}`, rpcInvalidParams)
+	testAndValidateRPCError(t, addr,
+		`{"jsonrpc": "2.0", "method": "test.put", "params": [1], "id": 9}`, rpcInvalidParams)
+	testAndValidateRPCError(t, addr,
+		`{"jsonrpc": "2.0", "method": "test.bogus", "id": 10}`, rpcMethodNotFound)
+	testAndValidateRPCError(t, addr,
+		`{"jsonrpc": "2.0", "method": "bogus.get", "id": 11}`, rpcMethodNotFound)
+	testAndValidateRPCError(t, addr, `{"method": "test.get", "id": 12}`, rpcInvalidRequest)
+	testAndValidateRPCError(t, addr, `{"jsonrpc": "2.0", "method"`, rpcParseError)
+	testAndValidateRPCError(t, addr, `[]`, rpcInvalidRequest)
+
+	// Notifications have no response.
+	status, _ := testRPCReq(t, addr,
+		`{"jsonrpc": "2.0", "method": "test.new", "params": [{"Name": "Test 3"}]}`)
+	if status != http.StatusNoContent {
+		t.Errorf("Expected %d from notification, got %d", http.StatusNoContent, status)
+	}
+	if s.data[3] == nil {
+		t.Errorf("Notification not performed")
+	}
+
+	// Batches.
+	status, b := testRPCReq(t, addr, `[
+		{"jsonrpc": "2.0", "method": "test.get", "params": [1], "id": "a"},
+		{"jsonrpc": "2.0", "method": "test.delete", "params": [3]},
+		1,
+		{"jsonrpc": "2.0", "method": "test.get", "params": [3], "id": "b"}
+	]`)
+	if status != http.StatusOK {
+		t.Fatalf("Expected %d from batch, got %d", http.StatusOK, status)
+	}
+	var batch []testRPCResponse
+	err = json.Unmarshal(b, &batch)
+	if err != nil {
+		t.Fatalf("Can't decode batch response %s: %v", string(b), err)
+	}
+	if len(batch) != 3 {
+		t.Fatalf("Expected 3 batch responses, got %d", len(batch))
+	}
+	if string(batch[0].ID) != `"a"` || batch[0].Error != nil ||
+		!strings.Contains(string(batch[0].Result), "Test 1 put") {
+		t.Errorf("Unexpected batch response %+v", batch[0])
+	}
+	if string(batch[1].ID) != "null" || batch[1].Error == nil ||
+		batch[1].Error.Code != rpcInvalidRequest {
+		t.Errorf("Unexpected batch response %+v", batch[1])
+	}
+	if string(batch[2].ID) != `"b"` || batch[2].Error == nil ||
+		batch[2].Error.Code != rpcServiceError {
+		t.Errorf("Unexpected batch response %+v", batch[2])
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/rpc", addr))
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected %d from GET, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
@@ -2,36 +2,154 @@ package lazy
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"reflect"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
 	"github.com/gorilla/mux"
+	"github.com/graphql-go/graphql"
 )
 
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
 var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
 
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
 type Response struct {
-	Error string      `json:"error,omitempt"`
-	Data  interface{} `json:"data,omitempt"`
+	Error string      `json:"error,omitempt" xml:"error,omitempty"`
+	Data  interface{} `json:"data,omitempt" xml:"data,omitempty"`
+
+	// RequestID identifies the request in server logs.  It is set on
+	// responses to failed requests.
+	RequestID string `json:"requestId,omitempty" xml:"requestId,omitempty"`
+}
+
+// Operation names an operation a service offers.
+type Operation string
+
+// Operations of every service.
+const (
+	OpGet    Operation = "get"
+	OpPut    Operation = "put"
+	OpNew    Operation = "new"
+	OpDelete Operation = "delete"
+	OpQuery  Operation = "query"
+)
+
+// Middleware wraps the handler of a service operation.
+type Middleware func(http.Handler) http.Handler
+
+// RouterOption configures a Router.
+type RouterOption func(*Router)
+
+// ServiceOption configures a service added with AddService.
+type ServiceOption func(*endpoint)
+
+// WithMiddleware wraps every operation of a service with mw.  The first
+// middleware is the outermost.  Operations requested over JSON-RPC and
+// GraphQL go through mw too, see JSONRPCHandler.
+func WithMiddleware(mw ...Middleware) ServiceOption {
+	return func(e *endpoint) {
+		e.middleware = append(e.middleware, mw...)
+	}
 }
 
 // Router routes all request to rest API services.
 type Router struct {
-	router *mux.Router
+	router  *mux.Router
+	codecs  *codecRegistry
+	metrics *metrics
+	tracer  Tracer
+	logger  *slog.Logger
+
+	// mu guards the services of the router.  endpoints holds them by
+	// prefix and order in the order they were added.  services routes
+	// requests to them, and is rebuilt when they change.
+	mu        sync.RWMutex
+	endpoints map[string]*endpoint
+	order     []*endpoint
+	services  atomic.Pointer[mux.Router]
+
+	// versions lists the versions of each versioned prefix in the order
+	// they were added.
+	versions      map[string][]string
+	versionHeader string
+
+	panicReporter    PanicReporter
+	timeouts         map[Operation]time.Duration
+	maxClientTimeout time.Duration
+
+	tenants         TenantResolver
+	batchTransactor Transactor
+
+	graphqlMu sync.Mutex
+	graphql   *graphql.Schema
 }
 
 type endpoint struct {
+	prefix      string
+	parent      *endpoint
+	router      *Router
+	version     string
+	deprecation *Deprecation
 	service     interface{}
 	serviceType reflect.Type
 	dataType    reflect.Type
+	codecs      *codecRegistry
+	metrics     *metrics
+	tracer      Tracer
+	logger      *slog.Logger
+	accessLog   bool
+	middleware  []Middleware
+
+	// routes are the routes of the service, relative to its path.
+	routes []route
+
+	// requests tracks the requests being served, so that removing the
+	// service can wait for them.
+	requests drain
+
+	panicReporter    PanicReporter
+	timeouts         map[Operation]time.Duration
+	maxClientTimeout time.Duration
+	rateLimiter      *rateLimiter
+	inFlight         semaphore
+	opInFlight       map[Operation]semaphore
+
+	idempotencyStore    IdempotencyStore
+	idempotencyInFlight sync.Map
+
+	cache *resultCache
+
+	softDelete *softDelete
+	auditSink  AuditSink
+	history    HistoryStore
+	transactor Transactor
+
+	// tenantServices holds the service instances of a service added as a
+	// tenant factory.
+	tenantServices *tenantServices
+
+	// factory creates the service instance of each request for a service
+	// added as a service factory.
+	factory reflect.Value
+
+	relations map[string]relation
+	getMulti  *reflect.Method
+	actions   map[string]*action
+
+	// calls handles the operations of other transports than REST.
+	calls map[Operation]http.Handler
 
 	get    reflect.Method
 	put    reflect.Method
@@ -60,20 +178,47 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 	return isExported(t.Name()) || t.PkgPath() == ""
 }
 
-func sendJsonResponse(w http.ResponseWriter, data interface{}) {
+// responseRecorder records the status and size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	size    int
+	written bool
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	w.status = status
+	w.written = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.written = true
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+// sendResponse sends data to the client.  If data can't be marshaled, a 500
+// is sent instead and the marshal error returned.
+func sendResponse(w http.ResponseWriter, codec Codec, data interface{}) error {
 	resp := Response{
 		Data: data,
 	}
 
-	b, err := json.Marshal(resp)
+	b, err := codec.Marshal(resp)
 	if err != nil {
-		log.Printf("Marshal error: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", codec.ContentType())
 	w.Write(b)
+	return nil
 }
 
 func (e *endpoint) findGet() error {
@@ -258,26 +403,335 @@ func (e *endpoint) findQuery() error {
 	return nil
 }
 
-func handleCallError(method string, v reflect.Value, w http.ResponseWriter) bool {
-	if !v.IsNil() {
-		err := v.Interface().(error)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func (e *endpoint) handleCallError(r *http.Request, method string, err error, w http.ResponseWriter) bool {
+	if err == nil {
+		return false
+	}
+
+	var perr *PanicError
+	if errors.As(err, &perr) {
+		// The panic was reported when it was recovered.
+		e.sendError(w, r, http.StatusInternalServerError, publicError(err).Error())
+		return true
+	}
+	if errors.Is(err, errSoftDeleted) || errors.Is(err, errNoVersion) {
+		e.sendError(w, r, http.StatusNotFound, err.Error())
 		return true
 	}
 
-	return false
+	logError(r.Context(), method+" error", err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		e.sendError(w, r, http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout))
+		return true
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+	return true
+}
+
+func handleDecodeError(r *http.Request, err error, w http.ResponseWriter) bool {
+	if err == nil {
+		return false
+	}
+
+	if err == errUnsupportedMediaType {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return true
+	}
+
+	logError(r.Context(), "Decode error", err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	return true
+}
+
+// responseCodec negotiates the codec used to encode the response to r.  If
+// no acceptable codec is registered, a 406 is sent and nil returned.
+func (e *endpoint) responseCodec(w http.ResponseWriter, r *http.Request) Codec {
+	codec := e.codecs.responseCodec(r, e.dataType)
+	if codec == nil {
+		http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+	}
+	return codec
 }
 
 func (e *endpoint) decodeData(r *http.Request) (*reflect.Value, error) {
-	data := reflect.New(e.dataType.Elem())
-	err := json.NewDecoder(r.Body).Decode(data.Interface())
+	return e.decode(r, e.dataType)
+}
+
+// decode decodes the body of r into a new value of dataType, a pointer type.
+func (e *endpoint) decode(r *http.Request, dataType reflect.Type) (*reflect.Value, error) {
+	_, span := e.tracer.Start(r.Context(), "decode")
+	defer span.End()
+
+	codec := e.codecs.requestCodec(r, dataType)
+	if codec == nil {
+		span.SetError(errUnsupportedMediaType)
+		return nil, errUnsupportedMediaType
+	}
+	span.SetAttribute("lazy.content_type", codec.ContentType())
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+
+	data := reflect.New(dataType.Elem())
+	err = codec.Unmarshal(body, data.Interface())
 	if err != nil {
+		span.SetError(err)
 		return nil, err
 	}
 	return &data, nil
 }
 
+// sendResponse sends data to the client, tracing the encoding.
+func (e *endpoint) sendResponse(w http.ResponseWriter, r *http.Request, codec Codec, data interface{}) {
+	_, span := e.tracer.Start(r.Context(), "encode")
+	defer span.End()
+
+	span.SetAttribute("lazy.content_type", codec.ContentType())
+	err := sendResponse(w, codec, data)
+	if err != nil {
+		span.SetError(err)
+		logError(r.Context(), "Marshal error", err)
+	}
+}
+
+// call invokes method on the service with ctx and args.  If ctx has a
+// deadline and the method only reads records, call returns when it expires
+// even if the method has not, with ctx.Err() as the error.  Methods that
+// change records are waited for, so that their changes are not made behind
+// the back of the cache, audit log, history and transaction.
+func (e *endpoint) call(ctx context.Context, method reflect.Method, args ...reflect.Value) []reflect.Value {
+	ctx, span := e.tracer.Start(ctx, "call")
+	defer span.End()
+	span.SetAttribute("lazy.method", method.Name)
+
+	recv, release, err := e.receiver(ctx)
+	if err != nil {
+		span.SetError(err)
+		return errorResults(method.Type, err)
+	}
+
+	in := append([]reflect.Value{recv, reflect.ValueOf(ctx)}, args...)
+	run := func() []reflect.Value {
+		defer release()
+		return e.invoke(ctx, method, in)
+	}
+	var out []reflect.Value
+	if _, ok := ctx.Deadline(); ok && e.reads(method) {
+		done := make(chan []reflect.Value, 1)
+		go func() {
+			done <- run()
+		}()
+		select {
+		case out = <-done:
+		case <-ctx.Done():
+			out = errorResults(method.Type, ctx.Err())
+		}
+	} else {
+		out = run()
+	}
+
+	if err := callError(out[len(out)-1]); err != nil {
+		span.SetError(err)
+	}
+	return out
+}
+
+// reads reports whether method is one of the service's methods that only
+// read records.
+func (e *endpoint) reads(method reflect.Method) bool {
+	return method.Name == e.get.Name || method.Name == e.query.Name ||
+		e.getMulti != nil && method.Name == e.getMulti.Name
+}
+
+// invoke calls method with in.  If the method panics, its results are zero
+// except for the error, which is a *PanicError.
+func (e *endpoint) invoke(ctx context.Context, method reflect.Method, in []reflect.Value) (out []reflect.Value) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+
+		perr := newPanicError(v)
+		e.reportPanic(ctx, perr)
+		out = errorResults(method.Type, perr)
+	}()
+
+	return method.Func.Call(in)
+}
+
+// errorResults returns the results of a call to a method of type t that
+// failed with err.
+func errorResults(t reflect.Type, err error) []reflect.Value {
+	out := make([]reflect.Value, t.NumOut())
+	for i := range out {
+		out[i] = reflect.Zero(t.Out(i))
+	}
+	errValue := reflect.New(typeOfError).Elem()
+	errValue.Set(reflect.ValueOf(err))
+	out[len(out)-1] = errValue
+	return out
+}
+
+func callError(v reflect.Value) error {
+	if v.IsNil() {
+		return nil
+	}
+	return v.Interface().(error)
+}
+
+// isCallFailure reports whether err is a failure of a service call itself,
+// a panic or an expired deadline, rather than an error the service returned.
+func isCallFailure(err error) bool {
+	var perr *PanicError
+	return errors.As(err, &perr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// The do* methods perform a single operation on the service.  They are shared
+// by all of the transports a Router offers.
+
+func (e *endpoint) doGet(ctx context.Context, id int) (interface{}, error) {
+	data, err := e.getRecord(ctx, id)
+	if err == nil && e.hidden(ctx, reflect.ValueOf(data)) {
+		return nil, fmt.Errorf("ID %d: %w", id, errSoftDeleted)
+	}
+	return data, err
+}
+
+// getRecord gets a record, whether or not it is soft deleted.
+func (e *endpoint) getRecord(ctx context.Context, id int) (interface{}, error) {
+	ctx, cancel := e.operationContext(ctx, OpGet)
+	defer cancel()
+
+	key := cacheKey{tenant: TenantFromContext(ctx), parents: parentKey(ctx), op: OpGet, id: id}
+	if data, ok := e.cache.get(key); ok {
+		return data, nil
+	}
+	gen := e.cache.generation()
+
+	values := e.call(ctx, e.get, reflect.ValueOf(id))
+	data, err := values[0].Interface(), callError(values[1])
+	if err == nil && TxFromContext(ctx) == nil {
+		e.cache.add(gen, key, data)
+	}
+	return data, err
+}
+
+func (e *endpoint) doPut(ctx context.Context, id int, data reflect.Value) error {
+	return e.transact(ctx, func(ctx context.Context) error {
+		before := e.auditBefore(ctx, id)
+		data, err := e.keepDeletedAt(ctx, id, data)
+		if err != nil {
+			return err
+		}
+		err = e.putRecord(ctx, id, data)
+		if err == nil {
+			e.audit(ctx, OpPut, id, before, data.Interface())
+		}
+		return err
+	})
+}
+
+// putRecord puts a record without auditing the change.
+func (e *endpoint) putRecord(ctx context.Context, id int, data reflect.Value) error {
+	ctx, cancel := e.operationContext(ctx, OpPut)
+	defer cancel()
+
+	values := e.call(ctx, e.put, reflect.ValueOf(id), data)
+	err := callError(values[0])
+	if err == nil {
+		e.invalidate(ctx, id)
+		e.snapshot(ctx, id, data.Interface())
+	}
+	return err
+}
+
+func (e *endpoint) doNew(ctx context.Context, data reflect.Value) (int, error) {
+	var id int
+	err := e.transact(ctx, func(ctx context.Context) error {
+		ctx, cancel := e.operationContext(ctx, OpNew)
+		defer cancel()
+
+		values := e.call(ctx, e.new, data)
+		var err error
+		id, err = int(values[0].Int()), callError(values[1])
+		if err == nil {
+			e.invalidate(ctx, id)
+			e.snapshot(ctx, id, data.Interface())
+			e.audit(ctx, OpNew, id, nil, data.Interface())
+		}
+		return err
+	})
+	return id, err
+}
+
+func (e *endpoint) doDelete(ctx context.Context, id int) error {
+	return e.transact(ctx, func(ctx context.Context) error {
+		before := e.auditBefore(ctx, id)
+		var err error
+		if e.softDelete != nil {
+			err = e.doSoftDelete(ctx, id)
+		} else {
+			err = e.purgeRecord(ctx, id)
+		}
+		if err == nil {
+			e.audit(ctx, OpDelete, id, before, nil)
+		}
+		return err
+	})
+}
+
+// purgeRecord deletes a record with the service's Delete method without
+// auditing the change.
+func (e *endpoint) purgeRecord(ctx context.Context, id int) error {
+	ctx, cancel := e.operationContext(ctx, OpDelete)
+	defer cancel()
+
+	values := e.call(ctx, e.delete, reflect.ValueOf(id))
+	err := callError(values[0])
+	if err == nil {
+		e.invalidate(ctx, id)
+		e.snapshot(ctx, id, nil)
+	}
+	return err
+}
+
+func (e *endpoint) doQuery(ctx context.Context, args url.Values) (interface{}, error) {
+	results, err := e.queryRecords(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return e.visible(ctx, results), nil
+}
+
+// queryRecords queries records, whether or not they are soft deleted.
+func (e *endpoint) queryRecords(ctx context.Context, args url.Values) (interface{}, error) {
+	ctx, cancel := e.operationContext(ctx, OpQuery)
+	defer cancel()
+
+	key := cacheKey{tenant: TenantFromContext(ctx), parents: parentKey(ctx), op: OpQuery, args: args.Encode()}
+	if results, ok := e.cache.get(key); ok {
+		return results, nil
+	}
+	gen := e.cache.generation()
+
+	values := e.call(ctx, e.query, reflect.ValueOf(args))
+	results, err := values[0].Interface(), callError(values[1])
+	if err == nil && TxFromContext(ctx) == nil {
+		e.cache.add(gen, key, results)
+	}
+	return results, err
+}
+
 func (e *endpoint) handleGet(w http.ResponseWriter, r *http.Request) {
+	codec := e.responseCodec(w, r)
+	if codec == nil {
+		return
+	}
+
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
@@ -285,20 +739,36 @@ func (e *endpoint) handleGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	values := e.get.Func.Call([]reflect.Value{
-		reflect.ValueOf(e.service),
-		reflect.ValueOf(r.Context()),
-		reflect.ValueOf(id)})
-	data := values[0].Interface()
+	asOf, err := e.asOf(r)
+	if err != nil {
+		e.sendError(w, r, http.StatusBadRequest, "Invalid "+AsOfParam)
+		return
+	}
 
-	if handleCallError("Get", values[1], w) {
+	var data interface{}
+	if asOf.IsZero() {
+		data, err = e.doGet(e.readContext(r), id)
+	} else {
+		data, err = e.doGetAsOf(e.readContext(r), id, asOf)
+	}
+	if e.handleCallError(r, "Get", err, w) {
+		return
+	}
+	data, ok := e.expandResponse(w, r, codec, data)
+	if !ok {
 		return
 	}
+	e.cache.setCacheControl(w)
 
-	sendJsonResponse(w, data)
+	e.sendResponse(w, r, codec, data)
 }
 
 func (e *endpoint) handlePut(w http.ResponseWriter, r *http.Request) {
+	codec := e.responseCodec(w, r)
+	if codec == nil {
+		return
+	}
+
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
@@ -307,44 +777,43 @@ func (e *endpoint) handlePut(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data, err := e.decodeData(r)
-	if err != nil {
-		log.Printf("Decode error: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	if handleDecodeError(r, err, w) {
 		return
 	}
 
-	values := e.put.Func.Call([]reflect.Value{
-		reflect.ValueOf(e.service),
-		reflect.ValueOf(r.Context()),
-		reflect.ValueOf(id),
-		*data})
-	if handleCallError("Put", values[0], w) {
+	err = e.doPut(r.Context(), id, *data)
+	if e.handleCallError(r, "Put", err, w) {
 		return
 	}
 
-	sendJsonResponse(w, id)
+	e.sendResponse(w, r, codec, id)
 }
 
 func (e *endpoint) handleNew(w http.ResponseWriter, r *http.Request) {
+	codec := e.responseCodec(w, r)
+	if codec == nil {
+		return
+	}
+
 	data, err := e.decodeData(r)
-	if err != nil {
-		log.Printf("Decode error: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	if handleDecodeError(r, err, w) {
 		return
 	}
 
-	values := e.new.Func.Call([]reflect.Value{
-		reflect.ValueOf(e.service),
-		reflect.ValueOf(r.Context()),
-		*data})
-	if handleCallError("New", values[1], w) {
+	id, err := e.doNew(r.Context(), *data)
+	if e.handleCallError(r, "New", err, w) {
 		return
 	}
 
-	sendJsonResponse(w, values[0].Interface())
+	e.sendResponse(w, r, codec, id)
 }
 
 func (e *endpoint) handleDelete(w http.ResponseWriter, r *http.Request) {
+	codec := e.responseCodec(w, r)
+	if codec == nil {
+		return
+	}
+
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
@@ -352,77 +821,321 @@ func (e *endpoint) handleDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	values := e.delete.Func.Call([]reflect.Value{
-		reflect.ValueOf(e.service),
-		reflect.ValueOf(r.Context()),
-		reflect.ValueOf(id)})
-	if handleCallError("Delete", values[0], w) {
+	err = e.doDelete(r.Context(), id)
+	if e.handleCallError(r, "Delete", err, w) {
 		return
 	}
 
-	sendJsonResponse(w, id)
+	e.sendResponse(w, r, codec, id)
 }
 
 func (e *endpoint) handleQuery(w http.ResponseWriter, r *http.Request) {
-	values := e.query.Func.Call([]reflect.Value{
-		reflect.ValueOf(e.service),
-		reflect.ValueOf(r.Context()),
-		reflect.ValueOf(r.URL.Query()),
-	})
-	if handleCallError("Query", values[1], w) {
+	codec := e.responseCodec(w, r)
+	if codec == nil {
 		return
 	}
 
-	sendJsonResponse(w, values[0].Interface())
+	args := r.URL.Query()
+	if len(e.relations) > 0 {
+		args.Del(ExpandParam)
+	}
+	if e.softDelete != nil {
+		args.Del(IncludeDeletedParam)
+	}
+	results, err := e.doQuery(e.readContext(r), args)
+	if e.handleCallError(r, "Query", err, w) {
+		return
+	}
+	results, ok := e.expandResponse(w, r, codec, results)
+	if !ok {
+		return
+	}
+	e.cache.setCacheControl(w)
+
+	e.sendResponse(w, r, codec, results)
+}
+
+// serve returns the http.Handler for operation op, which is handled by h.
+// It wraps h with the service's limits and middleware and records metrics.
+func (e *endpoint) serve(op Operation, h http.HandlerFunc) http.Handler {
+	handler := e.instrument(op, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !e.requests.enter() {
+			// The service was removed or replaced after the request was
+			// routed to it.
+			e.router.serveServices(w, r)
+			return
+		}
+		defer e.requests.exit()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// instrument wraps h, the handler of operation op, with the service's
+// limits and middleware, and records metrics, spans and the access log.  It
+// is shared by all of the transports a Router offers.
+func (e *endpoint) instrument(op Operation, h http.Handler) http.Handler {
+	handler := e.limited(op, e.withParents(e.idempotent(op, h)))
+	for i := len(e.middleware) - 1; i >= 0; i-- {
+		handler = e.middleware[i](handler)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := newResponseRecorder(w)
+		if e.version != "" {
+			rec.Header().Set(e.router.versionHeader, e.version)
+		}
+		e.setDeprecationHeaders(rec)
+
+		ctx, logger := requestContext(rec, r, e.logger.With(
+			slog.String("prefix", e.prefix),
+			slog.String("operation", string(op))))
+		ctx, cancel := clientTimeoutContext(ctx, r, e.maxClientTimeout)
+		defer cancel()
+		if sc, err := ParseTraceParent(r.Header.Get("traceparent")); err == nil {
+			ctx = ContextWithRemoteSpanContext(ctx, sc)
+		}
+		ctx, span := e.tracer.Start(ctx, e.prefix+"."+string(op))
+		span.SetAttribute("lazy.prefix", e.prefix)
+		span.SetAttribute("lazy.operation", string(op))
+		span.SetAttribute("http.method", r.Method)
+
+		ctx, closeScope := openServiceScope(ctx)
+		defer closeScope()
+		e.serveRecovered(handler, rec, r.WithContext(ctx))
+
+		span.SetAttribute("http.status_code", rec.status)
+		if rec.status >= http.StatusInternalServerError {
+			span.SetError(errors.New(http.StatusText(rec.status)))
+		}
+		span.End()
+
+		latency := time.Since(start)
+		e.metrics.observe(e.prefix, op, rec.status, latency, rec.size)
+		if e.accessLog {
+			logger.LogAttrs(ctx, slog.LevelInfo, "request",
+				slog.String("id", mux.Vars(r)["id"]),
+				slog.Int("status", rec.status),
+				slog.Duration("latency", latency),
+				slog.Int("size", rec.size))
+		}
+	})
+}
+
+// NewRouter creates a new Router.  The Router understands JSON bodies, and
+// other encodings such as XMLCodec once registered with RegisterCodec.
+// Services whose data type is a protocol buffer message additionally
+// understand the binary and JSON protobuf encodings.
+func NewRouter(opts ...RouterOption) *Router {
+	r := &Router{
+		router:    mux.NewRouter(),
+		codecs:    newCodecRegistry(JSONCodec{}, ProtobufCodec{}, ProtoJSONCodec{}),
+		metrics:   newMetrics(),
+		tracer:    nopTracer{},
+		endpoints: make(map[string]*endpoint),
+
+		timeouts:         make(map[Operation]time.Duration),
+		maxClientTimeout: DefaultMaxClientTimeout,
+		versions:         make(map[string][]string),
+		versionHeader:    VersionHeader,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.services.Store(mux.NewRouter())
+	r.router.NotFoundHandler = http.HandlerFunc(r.serveServices)
+	return r
+}
+
+// RegisterCodec makes c available for content negotiation on all services of
+// the router.  A codec previously registered for the same content type is
+// replaced.
+func (r *Router) RegisterCodec(c Codec) {
+	r.codecs.register(c)
 }
 
-// NewRouter creates a new Router.
-func NewRouter() *Router {
-	return &Router{
-		router: mux.NewRouter(),
+// AddService adds a service to the router.  Instead of a service, it accepts
+// a service factory, a function with the signature
+//
+//	func(ctx context.Context) (Service, error)
+//
+// which is called with the request context to create a service instance for
+// each request that uses the service, e.g. one bound to a database
+// transaction.  If the instance has a Close() error method, it is called
+// once the response has been written.  The context passed to the factory
+// lasts until then, however short the timeouts of its operations.
+//
+// Routers with tenants also accept a tenant factory, a function with the
+// signature
+//
+//	func(tenant string) (Service, error)
+//
+// which is called to create the service instance of each tenant the first
+// time the tenant uses the service.
+//
+// AddService fails if a service with the same prefix was added already.
+func (r *Router) AddService(prefix string, service interface{}, opts ...ServiceOption) error {
+	return r.addService("", prefix, service, opts...)
+}
+
+// addService adds a service, below the records of the service with prefix
+// parent if it is not empty.
+func (r *Router) addService(parent string, prefix string, service interface{}, opts ...ServiceOption) error {
+	r.mu.Lock()
+	err := r.addServiceLocked(parent, prefix, service, opts...)
+	r.mu.Unlock()
+	if err != nil {
+		return err
 	}
+	r.resetGraphQL()
+	return nil
 }
 
-// AddService adds a service to the router.
-func (r *Router) AddService(prefix string, service interface{}) error {
+// addServiceLocked adds a service.  r.mu must be held.
+func (r *Router) addServiceLocked(parent string, prefix string, service interface{}, opts ...ServiceOption) error {
+	var p *endpoint
+	if parent != "" {
+		var ok bool
+		p, ok = r.endpoints[parent]
+		if !ok {
+			return fmt.Errorf("Parent service %s not found", parent)
+		}
+	}
+	e, err := r.newEndpoint(p, prefix, service, opts...)
+	if err != nil {
+		return err
+	}
+	if _, ok := r.endpoints[e.prefix]; ok {
+		return fmt.Errorf("Service %s already added", e.prefix)
+	}
+
+	if e.version != "" {
+		r.addVersion(prefix, e)
+	}
+	r.endpoints[e.prefix] = e
+	r.order = append(r.order, e)
+	r.rebuild()
+	return nil
+}
+
+// newEndpoint creates the endpoint of a service, below the records of parent
+// if it is not nil.  r.mu must be held.
+func (r *Router) newEndpoint(parent *endpoint, prefix string, service interface{}, opts ...ServiceOption) (*endpoint, error) {
+	if parent != nil {
+		prefix = parent.prefix + "/" + prefix
+	}
 	e := &endpoint{
+		prefix:      prefix,
+		parent:      parent,
+		router:      r,
 		service:     service,
 		serviceType: reflect.TypeOf(service),
+		codecs:      r.codecs,
+		metrics:     r.metrics,
+		tracer:      r.tracer,
+		logger:      r.baseLogger(),
+		accessLog:   r.logger != nil,
+
+		panicReporter:    r.panicReporter,
+		timeouts:         make(map[Operation]time.Duration),
+		maxClientTimeout: r.maxClientTimeout,
+		opInFlight:       make(map[Operation]semaphore),
+	}
+	for op, d := range r.timeouts {
+		e.timeouts[op] = d
+	}
+	switch {
+	case isServiceFactory(service):
+		e.factory = reflect.ValueOf(service)
+	case isTenantFactory(service):
+		if r.tenants == nil {
+			return nil, fmt.Errorf("Service %s is a tenant factory, but the router has no tenants", prefix)
+		}
+		e.tenantServices = &tenantServices{
+			factory:   reflect.ValueOf(service),
+			instances: make(map[string]reflect.Value),
+		}
+	}
+	if e.factory.IsValid() || e.tenantServices != nil {
+		e.service = nil
+		e.serviceType = e.serviceType.Out(0)
+		if e.serviceType.Kind() == reflect.Interface {
+			return nil, fmt.Errorf("Factory of %s must return a concrete type, not %v", prefix, e.serviceType)
+		}
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	if parent == nil && e.version == "" && len(r.versions[prefix]) > 0 {
+		return nil, fmt.Errorf("Service %s has versions; add it with WithVersion", prefix)
+	}
+	if e.version != "" {
+		if parent != nil {
+			return nil, fmt.Errorf("Child services take the version of their parent")
+		}
+		if _, ok := r.endpoints[prefix]; ok {
+			return nil, fmt.Errorf("Service %s was added without a version", prefix)
+		}
+		e.prefix = e.version + "/" + prefix
 	}
 
 	// TODO(konkers): Support partial endpoints
 	err := e.findGet()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = e.findPut()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = e.findNew()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = e.findDelete()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = e.findQuery()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	err = e.findGetMulti()
+	if err != nil {
+		return nil, err
+	}
+	err = e.findRelations()
+	if err != nil {
+		return nil, err
+	}
+	err = e.findActions()
+	if err != nil {
+		return nil, err
+	}
+	err = e.findDeletedAt()
+	if err != nil {
+		return nil, err
 	}
 
-	s := r.router.PathPrefix("/" + prefix).Subrouter()
-	s.HandleFunc("/get/{id:[0-9]+}", e.handleGet)
-	s.HandleFunc("/put/{id:[0-9]+}", e.handlePut)
-	s.HandleFunc("/new", e.handleNew)
-	s.HandleFunc("/delete/{id:[0-9]+}", e.handleDelete)
-	s.HandleFunc("/query", e.handleQuery)
+	e.handle("/get/{id:[0-9]+}", e.serve(OpGet, e.handleGet))
+	e.handle("/put/{id:[0-9]+}", e.serve(OpPut, e.handlePut))
+	e.handle("/new", e.serve(OpNew, e.handleNew))
+	e.handle("/delete/{id:[0-9]+}", e.serve(OpDelete, e.handleDelete))
+	e.handle("/query", e.serve(OpQuery, e.handleQuery))
+	e.addSoftDeleteRoutes()
+	e.addHistoryRoutes()
+	if e.auditSink != nil {
+		e.handle("/audit", e.serve(OpAudit, e.handleAudit))
+	}
+	e.addActionRoutes()
+	e.addCallHandlers()
 
-	return nil
+	return e, nil
 }
 
 // ServeHTTP implements the http.Handler interface.
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	r.router.ServeHTTP(w, req)
+	r.withTenant(r.router).ServeHTTP(w, req)
 }
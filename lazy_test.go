@@ -304,14 +304,8 @@ func testBadPost(t *testing.T, addr string, uri string, data interface{}) {
 	}
 }
 
-func TestNewService(t *testing.T) {
-	r := NewRouter()
-	s := NewTestService()
-	err := r.AddService("test", s)
-	if err != nil {
-		t.Fatalf("Can't add service: %v", err)
-	}
-
+// startTestServer serves h on a free local port and returns its address.
+func startTestServer(t *testing.T, h http.Handler) string {
 	port, err := freeport.GetFreePort()
 	if err != nil {
 		t.Fatalf("Can't get free port: %v", err)
@@ -319,8 +313,11 @@ func TestNewService(t *testing.T) {
 	}
 	addr := fmt.Sprintf("127.0.0.1:%d", port)
 	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Can't listen on %s: %v", addr, err)
+	}
 	srv := &http.Server{
-		Handler: r,
+		Handler: h,
 		Addr:    addr,
 		// Good practice: enforce timeouts for servers you create!
 		WriteTimeout: 15 * time.Second,
@@ -328,6 +325,18 @@ func TestNewService(t *testing.T) {
 	}
 
 	go srv.Serve(listener)
+	return addr
+}
+
+func TestNewService(t *testing.T) {
+	r := NewRouter()
+	s := NewTestService()
+	err := r.AddService("test", s)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+
+	addr := startTestServer(t, r)
 
 	testAndValidateNewReq(t, addr, &TestData{ID: 1, Name: "Test 1"})
 	testAndValidateNewReq(t, addr, &TestData{ID: 2, Name: "Test 2"})
@@ -385,8 +394,8 @@ func TestNewService(t *testing.T) {
 
 func TestEncodeError(t *testing.T) {
 	w := NewDummyResponseWriter()
-	sendJsonResponse(w, make(chan int))
+	sendResponse(w, JSONCodec{}, make(chan int))
 	if w.StatusCode == http.StatusOK {
-		t.Errorf("Expected failure from sendJsonResponse on unencodable data")
+		t.Errorf("Expected failure from sendResponse on unencodable data")
 	}
 }
@@ -0,0 +1,109 @@
+package lazy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+// RequestIDHeader is the header carrying request ids.  An id sent by the
+// client is used as is; otherwise one is generated.  The id is echoed in the
+// response.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+type loggerKey struct{}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func contextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the id of the request ctx belongs to, or "" if
+// ctx does not belong to a service request.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestContext returns the context for handling req.  It carries the
+// request's id, which is echoed in w, and logger annotated with the id.
+func requestContext(w http.ResponseWriter, req *http.Request, logger *slog.Logger) (context.Context, *slog.Logger) {
+	id := req.Header.Get(RequestIDHeader)
+	if id == "" {
+		id = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, id)
+
+	logger = logger.With(slog.String("request_id", id))
+	ctx := contextWithRequestID(req.Context(), id)
+	return ContextWithLogger(ctx, logger), logger
+}
+
+// ContextWithLogger returns a copy of ctx carrying logger.
+func ContextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFromContext returns the logger in ctx.  Contexts passed to service
+// methods carry a logger annotated with the request id, service prefix and
+// operation.  slog.Default() is returned if ctx has no logger.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// errorChain lists the messages of err and every error it wraps.
+func errorChain(err error) []string {
+	var chain []string
+	errs := []error{err}
+	for len(errs) > 0 {
+		err, errs = errs[0], errs[1:]
+		if err == nil {
+			continue
+		}
+		chain = append(chain, err.Error())
+		switch u := err.(type) {
+		case interface{ Unwrap() error }:
+			errs = append(errs, u.Unwrap())
+		case interface{ Unwrap() []error }:
+			errs = append(errs, u.Unwrap()...)
+		}
+	}
+	return chain
+}
+
+// logError logs err, which occurred while handling a request, with its chain
+// of wrapped errors.
+func logError(ctx context.Context, msg string, err error) {
+	attrs := []slog.Attr{slog.String("error", err.Error())}
+	if chain := errorChain(err); len(chain) > 1 {
+		attrs = append(attrs, slog.Any("error_chain", chain))
+	}
+	LoggerFromContext(ctx).LogAttrs(ctx, slog.LevelError, msg, attrs...)
+}
+
+// WithLogger logs through logger.  Besides errors, an access log entry is
+// written for every service request.
+func WithLogger(logger *slog.Logger) RouterOption {
+	return func(r *Router) {
+		r.logger = logger
+	}
+}
+
+// baseLogger returns the logger for messages not tied to a service request.
+func (r *Router) baseLogger() *slog.Logger {
+	if r.logger != nil {
+		return r.logger
+	}
+	return slog.Default()
+}
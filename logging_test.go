@@ -0,0 +1,140 @@
+package lazy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var errTestNotFound = errors.New("not found")
+
+type LoggingTestService struct {
+	TestService
+	LastRequestID string
+}
+
+func (s *LoggingTestService) Get(ctx context.Context, id int) (*TestData, error) {
+	s.LastRequestID = RequestIDFromContext(ctx)
+	LoggerFromContext(ctx).Info("service get", "record", id)
+
+	data, err := s.TestService.Get(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("get %d: %w", id, errTestNotFound)
+	}
+	return data, nil
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// entries decodes the JSON log entries written so far.
+func (b *syncBuffer) entries(t *testing.T) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		err := json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			t.Fatalf("Can't decode log entry %s: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func findLogEntry(t *testing.T, entries []map[string]interface{}, msg string) map[string]interface{} {
+	for _, entry := range entries {
+		if entry["msg"] == msg {
+			return entry
+		}
+	}
+	t.Fatalf("No %q log entry in %v", msg, entries)
+	return nil
+}
+
+func TestLogging(t *testing.T) {
+	buf := &syncBuffer{}
+	r := NewRouter(WithLogger(slog.New(slog.NewJSONHandler(buf, nil))))
+	s := &LoggingTestService{TestService: *NewTestService()}
+	err := r.AddService("test", s)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	testAndValidateNewReq(t, addr, &TestData{ID: 1, Name: "Test 1"})
+	entries := buf.entries(t)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 log entry, got %v", entries)
+	}
+	access := entries[0]
+	if access["msg"] != "request" || access["prefix"] != "test" || access["operation"] != "new" ||
+		access["status"] != float64(http.StatusOK) || access["request_id"] == "" ||
+		access["latency"] == nil {
+		t.Errorf("Unexpected access log entry %v", access)
+	}
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/test/get/2", addr), nil)
+	req.Header.Set(RequestIDHeader, "test-request")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	if resp.Header.Get(RequestIDHeader) != "test-request" {
+		t.Errorf("Expected request id to be echoed, got %q", resp.Header.Get(RequestIDHeader))
+	}
+	if s.LastRequestID != "test-request" {
+		t.Errorf("Expected service to see request id, got %q", s.LastRequestID)
+	}
+
+	entries = buf.entries(t)[1:]
+	for _, entry := range entries {
+		if entry["request_id"] != "test-request" {
+			t.Errorf("Expected entry to carry the request id: %v", entry)
+		}
+	}
+	if findLogEntry(t, entries, "service get")["record"] != float64(2) {
+		t.Errorf("Expected service log entry to carry its attributes")
+	}
+	errEntry := findLogEntry(t, entries, "Get error")
+	expectedChain := []interface{}{"get 2: not found", "not found"}
+	if !reflect.DeepEqual(errEntry["error_chain"], expectedChain) {
+		t.Errorf("Expected error chain %v, got %v", expectedChain, errEntry["error_chain"])
+	}
+	access = findLogEntry(t, entries, "request")
+	if access["id"] != "2" || access["status"] != float64(http.StatusInternalServerError) {
+		t.Errorf("Unexpected access log entry %v", access)
+	}
+}
+
+func TestErrorChain(t *testing.T) {
+	a := errors.New("a")
+	b := errors.New("b")
+	err := fmt.Errorf("wrapped: %w", errors.Join(a, b))
+	expected := []string{"wrapped: a\nb", "a\nb", "a", "b"}
+	if chain := errorChain(err); !reflect.DeepEqual(chain, expected) {
+		t.Errorf("Expected chain %q, got %q", expected, chain)
+	}
+}
@@ -0,0 +1,169 @@
+package lazy
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the histogram buckets.
+var (
+	durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	sizeBuckets     = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+)
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	for i, bound := range buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+}
+
+type metricsKey struct {
+	prefix    string
+	operation Operation
+	status    int
+}
+
+type operationMetrics struct {
+	requests uint64
+	errors   uint64
+	duration *histogram
+	size     *histogram
+}
+
+// metrics collects statistics about the requests handled by the operations
+// of a Router's services.
+type metrics struct {
+	mu  sync.Mutex
+	ops map[metricsKey]*operationMetrics
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		ops: make(map[metricsKey]*operationMetrics),
+	}
+}
+
+func (m *metrics) observe(prefix string, op Operation, status int, duration time.Duration, size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := metricsKey{prefix: prefix, operation: op, status: status}
+	om, ok := m.ops[key]
+	if !ok {
+		om = &operationMetrics{
+			duration: newHistogram(durationBuckets),
+			size:     newHistogram(sizeBuckets),
+		}
+		m.ops[key] = om
+	}
+
+	om.requests++
+	if status >= http.StatusBadRequest {
+		om.errors++
+	}
+	om.duration.observe(durationBuckets, duration.Seconds())
+	om.size.observe(sizeBuckets, float64(size))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (k metricsKey) labels() string {
+	return fmt.Sprintf(`prefix="%s",operation="%s",status="%d"`,
+		labelEscaper.Replace(k.prefix), labelEscaper.Replace(string(k.operation)), k.status)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHistogram(w *bufio.Writer, name string, labels string, buckets []float64,
+	h *histogram, count uint64) {
+	for i, bound := range buckets {
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, count)
+}
+
+// writeText writes the metrics in the Prometheus text exposition format.
+func (m *metrics) writeText(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []metricsKey
+	for k := range m.ops {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].prefix != keys[j].prefix {
+			return keys[i].prefix < keys[j].prefix
+		}
+		if keys[i].operation != keys[j].operation {
+			return keys[i].operation < keys[j].operation
+		}
+		return keys[i].status < keys[j].status
+	})
+
+	fmt.Fprintln(w, "# HELP lazy_requests_total Number of requests handled by service operations.")
+	fmt.Fprintln(w, "# TYPE lazy_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "lazy_requests_total{%s} %d\n", k.labels(), m.ops[k].requests)
+	}
+
+	fmt.Fprintln(w, "# HELP lazy_request_errors_total Number of requests answered with an error status.")
+	fmt.Fprintln(w, "# TYPE lazy_request_errors_total counter")
+	for _, k := range keys {
+		if m.ops[k].errors > 0 {
+			fmt.Fprintf(w, "lazy_request_errors_total{%s} %d\n", k.labels(), m.ops[k].errors)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP lazy_request_duration_seconds Time taken to handle requests.")
+	fmt.Fprintln(w, "# TYPE lazy_request_duration_seconds histogram")
+	for _, k := range keys {
+		om := m.ops[k]
+		writeHistogram(w, "lazy_request_duration_seconds", k.labels(), durationBuckets,
+			om.duration, om.requests)
+	}
+
+	fmt.Fprintln(w, "# HELP lazy_response_size_bytes Size of response bodies.")
+	fmt.Fprintln(w, "# TYPE lazy_response_size_bytes histogram")
+	for _, k := range keys {
+		om := m.ops[k]
+		writeHistogram(w, "lazy_response_size_bytes", k.labels(), sizeBuckets, om.size, om.requests)
+	}
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	m.writeText(bw)
+	bw.Flush()
+}
+
+// MetricsHandler returns an http.Handler that exposes request counts, error
+// counts, latencies and response sizes of every service operation in the
+// Prometheus text format.  Metrics are labeled by service prefix, operation
+// and response status.
+func (r *Router) MetricsHandler() http.Handler {
+	return r.metrics
+}
@@ -0,0 +1,87 @@
+package lazy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	r := NewRouter()
+	s := NewTestService()
+	err := r.AddService("test", s)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", r)
+	mux.Handle("/metrics", r.MetricsHandler())
+	addr := startTestServer(t, mux)
+
+	testAndValidateNewReq(t, addr, &TestData{ID: 1, Name: "Test 1"})
+	testAndValidateGetReq(t, addr, 1, "Test 1")
+	testAndValidateGetReq(t, addr, 1, "Test 1")
+	testGetReq(addr, 2)
+
+	// Metrics are recorded after the response is sent, so wait for the last
+	// request to show up.
+	var body string
+	for i := 0; i < 100; i++ {
+		_, body = testAdminGet(t, addr, "/metrics")
+		if strings.Contains(body, `status="500"`) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, line := range []string{
+		"# TYPE lazy_requests_total counter",
+		`lazy_requests_total{prefix="test",operation="get",status="200"} 2`,
+		`lazy_requests_total{prefix="test",operation="get",status="500"} 1`,
+		`lazy_requests_total{prefix="test",operation="new",status="200"} 1`,
+		`lazy_request_errors_total{prefix="test",operation="get",status="500"} 1`,
+		"# TYPE lazy_request_duration_seconds histogram",
+		`lazy_request_duration_seconds_bucket{prefix="test",operation="get",status="200",le="+Inf"} 2`,
+		`lazy_request_duration_seconds_count{prefix="test",operation="get",status="200"} 2`,
+		"# TYPE lazy_response_size_bytes histogram",
+		`lazy_response_size_bytes_bucket{prefix="test",operation="new",status="200",le="100"} 1`,
+		`lazy_response_size_bytes_sum{prefix="test",operation="new",status="200"} 21`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected metrics to contain %q:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, `lazy_request_errors_total{prefix="test",operation="get",status="200"}`) {
+		t.Errorf("Unexpected error count for successful requests:\n%s", body)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	m := newMetrics()
+	m.observe("a\"b", OpQuery, http.StatusOK, 20*time.Millisecond, 5000)
+	m.observe("a\"b", OpQuery, http.StatusOK, 2*time.Second, 50)
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	m.writeText(w)
+	w.Flush()
+
+	labels := `prefix="a\"b",operation="query",status="200"`
+	for _, line := range []string{
+		`lazy_request_duration_seconds_bucket{%s,le="0.01"} 0`,
+		`lazy_request_duration_seconds_bucket{%s,le="0.025"} 1`,
+		`lazy_request_duration_seconds_bucket{%s,le="2.5"} 2`,
+		`lazy_request_duration_seconds_sum{%s} 2.02`,
+		`lazy_response_size_bytes_bucket{%s,le="100"} 1`,
+		`lazy_response_size_bytes_bucket{%s,le="10000"} 2`,
+		`lazy_response_size_bytes_sum{%s} 5050`,
+	} {
+		line = fmt.Sprintf(line, labels)
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected metrics to contain %q:\n%s", line, buf.String())
+		}
+	}
+}
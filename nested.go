@@ -0,0 +1,126 @@
+package lazy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type parentIDsKey struct{}
+
+// ParentID returns the id of the record of the parent service with prefix
+// that the request ctx belongs to.  Contexts passed to the methods of a child
+// service carry the ids of all of its ancestors.
+func ParentID(ctx context.Context, prefix string) (int, bool) {
+	id, ok := parentIDs(ctx)[prefix]
+	return id, ok
+}
+
+// parentIDs returns the parent ids in ctx by the prefixes of the parent
+// services, or nil outside of child services.
+func parentIDs(ctx context.Context) map[string]int {
+	ids, _ := ctx.Value(parentIDsKey{}).(map[string]int)
+	return ids
+}
+
+func contextWithParentID(ctx context.Context, prefix string, id int) context.Context {
+	parents := parentIDs(ctx)
+	ids := make(map[string]int, len(parents)+1)
+	for p, id := range parents {
+		ids[p] = id
+	}
+	ids[prefix] = id
+	return context.WithValue(ctx, parentIDsKey{}, ids)
+}
+
+// parentKey encodes the parent ids in ctx, e.g.
+// "customers=1&customers%2Forders=2", to key results of child services by
+// their parent records.
+func parentKey(ctx context.Context) string {
+	ids := parentIDs(ctx)
+	if len(ids) == 0 {
+		return ""
+	}
+	v := url.Values{}
+	for prefix, id := range ids {
+		v.Set(prefix, strconv.Itoa(id))
+	}
+	return v.Encode()
+}
+
+// AddChildService adds a service whose records belong to records of the
+// service with prefix parent.  Its routes live below the parent's records,
+// e.g. "/customers/{id}/orders/get/{id}" for a child "orders" of "customers",
+// and its prefix is "customers/orders".  Children may themselves be parents.
+//
+// Before every operation on the child, the existence of the parent records
+// is checked with the parents' Get methods; requests for missing parents
+// fail with 404 Not Found.  The parent ids are available to the child's
+// methods through ParentID.
+//
+// Child services are only served over REST.
+func (r *Router) AddChildService(parent string, prefix string, service interface{}, opts ...ServiceOption) error {
+	return r.addService(parent, prefix, service, opts...)
+}
+
+// path returns the path template below which the routes of the service are
+// registered.
+func (e *endpoint) path() string {
+	if e.parent == nil {
+		return "/" + e.prefix
+	}
+	return e.parent.path() + "/{" + e.parent.prefix + ":[0-9]+}" +
+		strings.TrimPrefix(e.prefix, e.parent.prefix)
+}
+
+// ancestors lists the parents of the service, outermost first.  Parents
+// replaced since the service was added are listed as their replacements.
+func (e *endpoint) ancestors() []*endpoint {
+	var ancestors []*endpoint
+	for p := e.parent; p != nil; p = p.parent {
+		if current, ok := e.router.endpoint(p.prefix); ok {
+			p = current
+		}
+		ancestors = append([]*endpoint{p}, ancestors...)
+	}
+	return ancestors
+}
+
+// withParents wraps h with the checks that the parent records of the request
+// exist, and adds their ids to the request context.
+func (e *endpoint) withParents(h http.Handler) http.Handler {
+	if e.parent == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		ctx := r.Context()
+		for _, p := range e.ancestors() {
+			id, err := strconv.Atoi(vars[p.prefix])
+			if err != nil {
+				e.sendError(w, r, http.StatusBadRequest, "Invalid parent ID")
+				return
+			}
+
+			// Parents see the ids of their own ancestors.
+			ctx = contextWithParentID(ctx, p.prefix, id)
+			_, err = p.doGet(ctx, id)
+			if isCallFailure(err) {
+				e.handleCallError(r, "Parent Get", err, w)
+				return
+			}
+			if err != nil {
+				e.sendError(w, r, http.StatusNotFound, fmt.Sprintf("%s %d not found", p.prefix, id))
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
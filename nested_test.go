@@ -0,0 +1,104 @@
+package lazy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+type NestedTestService struct {
+	TestService
+	ParentIDs map[string]int
+}
+
+func (s *NestedTestService) Get(ctx context.Context, id int) (*TestData, error) {
+	for prefix := range s.ParentIDs {
+		s.ParentIDs[prefix], _ = ParentID(ctx, prefix)
+	}
+	return s.TestService.Get(ctx, id)
+}
+
+func testNestedReq(t *testing.T, method string, url string, body string) int {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s error: %v", method, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestChildService(t *testing.T) {
+	r := NewRouter()
+	customers := NewTestService()
+	orders := &NestedTestService{TestService: *NewTestService(), ParentIDs: map[string]int{"customers": 0}}
+	items := &NestedTestService{TestService: *NewTestService(),
+		ParentIDs: map[string]int{"customers": 0, "customers/orders": 0}}
+	err := r.AddService("customers", customers)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	err = r.AddChildService("customers", "orders", orders)
+	if err != nil {
+		t.Fatalf("Can't add child service: %v", err)
+	}
+	err = r.AddChildService("customers/orders", "items", items)
+	if err != nil {
+		t.Fatalf("Can't add grandchild service: %v", err)
+	}
+	err = r.AddChildService("missing", "orders", NewTestService())
+	if err == nil {
+		t.Errorf("Expected error adding child of missing service")
+	}
+	addr := startTestServer(t, r)
+
+	if status := testNestedReq(t, "POST", fmt.Sprintf("http://%s/customers/new", addr),
+		`{"name": "Customer 1"}`); status != http.StatusOK {
+		t.Fatalf("Expected customer to be created, got %d", status)
+	}
+	base := fmt.Sprintf("http://%s/customers/1/orders", addr)
+	if status := testNestedReq(t, "POST", base+"/new", `{"name": "Order 1"}`); status != http.StatusOK {
+		t.Fatalf("Expected order to be created, got %d", status)
+	}
+	if status := testNestedReq(t, "GET", base+"/get/1", ""); status != http.StatusOK {
+		t.Errorf("Expected order to be found, got %d", status)
+	}
+	if orders.ParentIDs["customers"] != 1 {
+		t.Errorf("Expected child to see parent id 1, got %v", orders.ParentIDs)
+	}
+
+	itemsBase := base + "/1/items"
+	if status := testNestedReq(t, "POST", itemsBase+"/new", `{"name": "Item 1"}`); status != http.StatusOK {
+		t.Fatalf("Expected item to be created, got %d", status)
+	}
+	testNestedReq(t, "GET", itemsBase+"/get/1", "")
+	if items.ParentIDs["customers"] != 1 || items.ParentIDs["customers/orders"] != 1 {
+		t.Errorf("Expected grandchild to see all parent ids, got %v", items.ParentIDs)
+	}
+
+	// Operations below missing parents fail.
+	for _, url := range []string{
+		fmt.Sprintf("http://%s/customers/2/orders/get/1", addr),
+		fmt.Sprintf("http://%s/customers/2/orders/query", addr),
+		fmt.Sprintf("http://%s/customers/1/orders/2/items/query", addr),
+	} {
+		if status := testNestedReq(t, "GET", url, ""); status != http.StatusNotFound {
+			t.Errorf("Expected 404 from %s, got %d", url, status)
+		}
+	}
+	if status := testNestedReq(t, "POST", fmt.Sprintf("http://%s/customers/2/orders/new", addr),
+		`{"name": "Order 2"}`); status != http.StatusNotFound {
+		t.Errorf("Expected 404 creating order of missing customer, got %d", status)
+	}
+	if len(orders.data) != 1 {
+		t.Errorf("Expected 1 order, got %d", len(orders.data))
+	}
+
+	services := r.Services()
+	if len(services) != 3 || services[1].Prefix != "customers/orders" ||
+		services[1].Parent != "customers" || services[1].Path != "/customers/{customers:[0-9]+}/orders" {
+		t.Errorf("Unexpected services %+v", services)
+	}
+}
@@ -0,0 +1,155 @@
+package lazy
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+var typeOfProtoMessage = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+// Query results are sent as a wrapper message equivalent to:
+//
+//	message List {
+//	  repeated T items = 1;
+//	}
+//
+// Ids returned by Put, New and Delete are sent as google.protobuf.Int64Value.
+const protoListItemsField = 1
+
+func isProtoType(t reflect.Type) bool {
+	return t.Implements(typeOfProtoMessage)
+}
+
+// protoPayload unwraps the response envelope, which has no protobuf
+// representation, and returns the data it carries.
+func protoPayload(v interface{}) interface{} {
+	switch resp := v.(type) {
+	case Response:
+		return resp.Data
+	case *Response:
+		return resp.Data
+	}
+	return v
+}
+
+// protoList returns the elements of v if it is a slice of messages.
+func protoList(v interface{}) ([]proto.Message, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice || !isProtoType(rv.Type().Elem()) {
+		return nil, false
+	}
+
+	msgs := make([]proto.Message, rv.Len())
+	for i := range msgs {
+		msgs[i] = rv.Index(i).Interface().(proto.Message)
+	}
+	return msgs, true
+}
+
+func protoUnmarshalTarget(v interface{}) (proto.Message, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protobuf message", v)
+	}
+	return msg, nil
+}
+
+// ProtobufCodec encodes bodies in the protobuf binary wire format.  It only
+// supports services whose data type is a protobuf message.
+type ProtobufCodec struct{}
+
+// ContentType implements the Codec interface.
+func (ProtobufCodec) ContentType() string { return "application/x-protobuf" }
+
+// Supports implements the TypedCodec interface.
+func (ProtobufCodec) Supports(dataType reflect.Type) bool { return isProtoType(dataType) }
+
+// Marshal implements the Codec interface.
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	v = protoPayload(v)
+	if id, ok := v.(int); ok {
+		return proto.Marshal(wrapperspb.Int64(int64(id)))
+	}
+	if msg, ok := v.(proto.Message); ok {
+		return proto.Marshal(msg)
+	}
+
+	msgs, ok := protoList(v)
+	if !ok {
+		return nil, fmt.Errorf("Can't encode %T as protobuf", v)
+	}
+	var b []byte
+	for _, msg := range msgs {
+		item, err := proto.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, protoListItemsField, protowire.BytesType)
+		b = protowire.AppendBytes(b, item)
+	}
+	return b, nil
+}
+
+// Unmarshal implements the Codec interface.
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, err := protoUnmarshalTarget(v)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// ProtoJSONCodec encodes bodies using the canonical protobuf JSON mapping.  It
+// only supports services whose data type is a protobuf message.
+type ProtoJSONCodec struct{}
+
+// ContentType implements the Codec interface.
+func (ProtoJSONCodec) ContentType() string { return "application/x-protobuf+json" }
+
+// Supports implements the TypedCodec interface.
+func (ProtoJSONCodec) Supports(dataType reflect.Type) bool { return isProtoType(dataType) }
+
+// Marshal implements the Codec interface.
+func (ProtoJSONCodec) Marshal(v interface{}) ([]byte, error) {
+	v = protoPayload(v)
+	if id, ok := v.(int); ok {
+		return protojson.Marshal(wrapperspb.Int64(int64(id)))
+	}
+	if msg, ok := v.(proto.Message); ok {
+		return protojson.Marshal(msg)
+	}
+
+	msgs, ok := protoList(v)
+	if !ok {
+		return nil, fmt.Errorf("Can't encode %T as protobuf JSON", v)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`{"items":[`)
+	for i, msg := range msgs {
+		item, err := protojson.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(item)
+	}
+	buf.WriteString("]}")
+	return buf.Bytes(), nil
+}
+
+// Unmarshal implements the Codec interface.
+func (ProtoJSONCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, err := protoUnmarshalTarget(v)
+	if err != nil {
+		return err
+	}
+	return protojson.Unmarshal(data, msg)
+}
@@ -0,0 +1,175 @@
+package lazy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// ProtoTestService stores protobuf messages to exercise the protobuf codecs.
+type ProtoTestService struct {
+	nextID int
+	data   map[int]*wrapperspb.StringValue
+}
+
+func (s *ProtoTestService) Get(ctx context.Context, id int) (*wrapperspb.StringValue, error) {
+	data, ok := s.data[id]
+	if !ok {
+		return nil, fmt.Errorf("ID %d does not exist", id)
+	}
+	return data, nil
+}
+
+func (s *ProtoTestService) Put(ctx context.Context, id int, data *wrapperspb.StringValue) error {
+	_, ok := s.data[id]
+	if !ok {
+		return fmt.Errorf("ID %d does not exist", id)
+	}
+	s.data[id] = data
+	return nil
+}
+
+func (s *ProtoTestService) New(ctx context.Context, data *wrapperspb.StringValue) (int, error) {
+	id := s.nextID
+	s.nextID = s.nextID + 1
+	s.data[id] = data
+	return id, nil
+}
+
+func (s *ProtoTestService) Delete(ctx context.Context, id int) error {
+	delete(s.data, id)
+	return nil
+}
+
+func (s *ProtoTestService) Query(ctx context.Context, args url.Values) ([]*wrapperspb.StringValue, error) {
+	var ids []int
+	for id := range s.data {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var results []*wrapperspb.StringValue
+	for _, id := range ids {
+		results = append(results, s.data[id])
+	}
+	return results, nil
+}
+
+func NewProtoTestService() *ProtoTestService {
+	return &ProtoTestService{
+		data:   make(map[int]*wrapperspb.StringValue),
+		nextID: 1,
+	}
+}
+
+func TestProtoCodecs(t *testing.T) {
+	r := NewRouter()
+	s := NewProtoTestService()
+	err := r.AddService("test", s)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	for _, name := range []string{"Test 1", "Test 2"} {
+		body, _ := proto.Marshal(wrapperspb.String(name))
+		resp, b := testCodecReq(t, "POST", fmt.Sprintf("http://%s/test/new", addr),
+			"application/x-protobuf", "application/x-protobuf", body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected protobuf New to succeed, got %d", resp.StatusCode)
+		}
+		var id wrapperspb.Int64Value
+		err = proto.Unmarshal(b, &id)
+		if err != nil {
+			t.Fatalf("Can't decode id: %v", err)
+		}
+		if s.data[int(id.Value)].GetValue() != name {
+			t.Errorf("Expected id %d to be %s", id.Value, name)
+		}
+	}
+
+	resp, b := testCodecReq(t, "GET", fmt.Sprintf("http://%s/test/get/2", addr),
+		"", "application/x-protobuf+json", nil)
+	if resp.Header.Get("Content-Type") != "application/x-protobuf+json" {
+		t.Errorf("Expected protojson response, got %s", resp.Header.Get("Content-Type"))
+	}
+	if string(b) != `"Test 2"` {
+		t.Errorf("Unexpected protojson response: %s", string(b))
+	}
+
+	resp, b = testCodecReq(t, "GET", fmt.Sprintf("http://%s/test/query", addr),
+		"", "application/x-protobuf", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected protobuf Query to succeed, got %d", resp.StatusCode)
+	}
+	var names []string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || num != protoListItemsField || typ != protowire.BytesType {
+			t.Fatalf("Unexpected field in query response")
+		}
+		b = b[n:]
+		item, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			t.Fatalf("Malformed query response")
+		}
+		b = b[n:]
+
+		var msg wrapperspb.StringValue
+		err = proto.Unmarshal(item, &msg)
+		if err != nil {
+			t.Fatalf("Can't decode query item: %v", err)
+		}
+		names = append(names, msg.Value)
+	}
+	if !reflect.DeepEqual(names, []string{"Test 1", "Test 2"}) {
+		t.Errorf("Unexpected query results %v", names)
+	}
+
+	resp, b = testCodecReq(t, "GET", fmt.Sprintf("http://%s/test/query", addr),
+		"", "application/x-protobuf+json", nil)
+	var list struct {
+		Items []string `json:"items"`
+	}
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		t.Fatalf("Can't decode protojson query response: %v", err)
+	}
+	if !reflect.DeepEqual(list.Items, []string{"Test 1", "Test 2"}) {
+		t.Errorf("Unexpected query results %v", list.Items)
+	}
+
+	body := []byte(`"Test 1 put"`)
+	resp, _ = testCodecReq(t, "POST", fmt.Sprintf("http://%s/test/put/1", addr),
+		"application/x-protobuf+json", "", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected protojson Put to succeed, got %d", resp.StatusCode)
+	}
+	if s.data[1].GetValue() != "Test 1 put" {
+		t.Errorf("Put did not update data: %v", s.data[1])
+	}
+}
+
+func TestProtoCodecsNotOffered(t *testing.T) {
+	r := NewRouter()
+	err := r.AddService("test", NewTestService())
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	resp, _ := testCodecReq(t, "GET", fmt.Sprintf("http://%s/test/query", addr),
+		"", "application/x-protobuf", nil)
+	if resp.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("Expected %d, got %d", http.StatusNotAcceptable, resp.StatusCode)
+	}
+}
@@ -0,0 +1,202 @@
+package lazy
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ClientKeyFunc identifies the client making a request for rate limiting.
+type ClientKeyFunc func(r *http.Request) string
+
+// ClientIP identifies clients by their IP address.  Proxy headers such as
+// X-Forwarded-For are not trusted; use a custom ClientKeyFunc behind a proxy.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ClientHeader identifies clients by the value of header, e.g. an API key.
+// Requests without the header are identified by IP address.
+func ClientHeader(header string) ClientKeyFunc {
+	return func(r *http.Request) string {
+		if v := r.Header.Get(header); v != "" {
+			return header + ":" + v
+		}
+		return ClientIP(r)
+	}
+}
+
+// WithRateLimit limits each client of the service to rate requests per
+// second, with bursts of up to burst requests.  Clients are identified by key,
+// or by IP address if key is nil.  Requests over the limit are rejected with
+// 429 Too Many Requests.
+//
+// Limits are checked after the service's middleware, so key may use values
+// middleware adds to the request context.
+func WithRateLimit(rate float64, burst int, key ClientKeyFunc) ServiceOption {
+	return func(e *endpoint) {
+		e.rateLimiter = newRateLimiter(rate, burst, key)
+	}
+}
+
+// WithMaxInFlight limits the number of requests the service handles at once
+// to n.  Requests over the limit are rejected with 503 Service Unavailable.
+func WithMaxInFlight(n int) ServiceOption {
+	return func(e *endpoint) {
+		e.inFlight = newSemaphore(n)
+	}
+}
+
+// WithOperationMaxInFlight limits the number of op requests the service
+// handles at once to n.  It applies in addition to WithMaxInFlight.
+func WithOperationMaxInFlight(op Operation, n int) ServiceOption {
+	return func(e *endpoint) {
+		e.opInFlight[op] = newSemaphore(n)
+	}
+}
+
+// rateLimitSweepInterval is how often a rateLimiter forgets clients whose
+// buckets have refilled.
+const rateLimitSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	key   ClientKeyFunc
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int, key ClientKeyFunc) *rateLimiter {
+	if key == nil {
+		key = ClientIP
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		key:       key,
+		now:       time.Now,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of client.  If the bucket is empty, it
+// returns how long until a token is available.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.rate <= 0 {
+		return false, rateLimitSweepInterval
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep forgets clients whose buckets are full again.
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// semaphore limits concurrency without blocking.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	return make(semaphore, n)
+}
+
+func (s semaphore) tryAcquire() bool {
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	<-s
+}
+
+// retryAfter formats d as the value of a Retry-After header, rounding up to
+// whole seconds.
+func retryAfter(d time.Duration) string {
+	secs := int(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.Itoa(secs)
+}
+
+// limited wraps h with the rate and concurrency limits of the service.
+func (e *endpoint) limited(op Operation, h http.Handler) http.Handler {
+	if e.rateLimiter == nil && e.inFlight == nil && e.opInFlight[op] == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e.rateLimiter != nil {
+			ok, wait := e.rateLimiter.allow(e.rateLimiter.key(r))
+			if !ok {
+				w.Header().Set("Retry-After", retryAfter(wait))
+				e.sendError(w, r, http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
+				return
+			}
+		}
+
+		for _, sem := range []semaphore{e.inFlight, e.opInFlight[op]} {
+			if sem == nil {
+				continue
+			}
+			if !sem.tryAcquire() {
+				w.Header().Set("Retry-After", retryAfter(time.Second))
+				e.sendError(w, r, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+				return
+			}
+			defer sem.release()
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
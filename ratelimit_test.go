@@ -0,0 +1,149 @@
+package lazy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type BlockingTestService struct {
+	TestService
+	entered chan struct{}
+	unblock chan struct{}
+}
+
+func (s *BlockingTestService) Get(ctx context.Context, id int) (*TestData, error) {
+	s.entered <- struct{}{}
+	<-s.unblock
+	return &TestData{ID: id}, nil
+}
+
+func testLimitReq(t *testing.T, addr string, path string, apiKey string) *http.Response {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s%s", addr, path), nil)
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestRateLimit(t *testing.T) {
+	r := NewRouter()
+	err := r.AddService("test", NewTestService(), WithRateLimit(0.001, 2, ClientHeader("X-API-Key")))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	for i := 0; i < 2; i++ {
+		resp := testLimitReq(t, addr, "/test/query", "noisy")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected request %d within burst to succeed, got %d", i, resp.StatusCode)
+		}
+	}
+	resp := testLimitReq(t, addr, "/test/query", "noisy")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 over the limit, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected Retry-After header on 429")
+	}
+
+	// Other clients have their own buckets.
+	resp = testLimitReq(t, addr, "/test/query", "quiet")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected other client to succeed, got %d", resp.StatusCode)
+	}
+	resp = testLimitReq(t, addr, "/test/query", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected client identified by IP to succeed, got %d", resp.StatusCode)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(2, 1, nil)
+	l.now = func() time.Time { return now }
+	l.lastSweep = now
+
+	if ok, _ := l.allow("a"); !ok {
+		t.Fatalf("Expected first request to be allowed")
+	}
+	ok, wait := l.allow("a")
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("Expected request to be rejected for 500ms, got %v %v", ok, wait)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.allow("a"); !ok {
+		t.Errorf("Expected request to be allowed after refill")
+	}
+
+	now = now.Add(rateLimitSweepInterval)
+	l.allow("b")
+	if _, ok := l.buckets["a"]; ok {
+		t.Errorf("Expected refilled bucket to be swept")
+	}
+
+	if retryAfter(1500*time.Millisecond) != "2" || retryAfter(0) != "1" {
+		t.Errorf("Unexpected Retry-After rounding")
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	r := NewRouter()
+	s := &BlockingTestService{
+		TestService: *NewTestService(),
+		entered:     make(chan struct{}),
+		unblock:     make(chan struct{}),
+	}
+	err := r.AddService("test", s, WithOperationMaxInFlight(OpGet, 1))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	done := make(chan int)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://%s/test/get/1", addr))
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	<-s.entered
+
+	resp := testLimitReq(t, addr, "/test/get/2", "")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 over the in-flight limit, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("Expected Retry-After header on 503, got %q", resp.Header.Get("Retry-After"))
+	}
+
+	// Other operations are not limited.
+	resp = testLimitReq(t, addr, "/test/query", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected query to succeed, got %d", resp.StatusCode)
+	}
+
+	close(s.unblock)
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("Expected blocked request to succeed, got %d", status)
+	}
+
+	// The slot is released when a request completes.
+	go func() { <-s.entered }()
+	resp = testLimitReq(t, addr, "/test/get/2", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected request after release to succeed, got %d", resp.StatusCode)
+	}
+}
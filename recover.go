@@ -0,0 +1,108 @@
+package lazy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// errInternal is reported to clients in place of errors whose details must
+// not leak, such as panics.
+var errInternal = errors.New(http.StatusText(http.StatusInternalServerError))
+
+// PanicError is a panic recovered while handling a request.  It is returned
+// in place of the results of a service method that panicked.
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value interface{}
+
+	// Stack is the stack trace of the goroutine that panicked.
+	Stack []byte
+}
+
+func newPanicError(v interface{}) *PanicError {
+	return &PanicError{Value: v, Stack: debug.Stack()}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// PanicReporter is called with every panic recovered while handling a
+// request, e.g. to forward it to an error reporting service.
+type PanicReporter func(ctx context.Context, err *PanicError)
+
+// WithPanicReporter calls f with every panic recovered while handling a
+// request.  Panics are logged with their stack trace whether or not a
+// reporter is set.
+func WithPanicReporter(f PanicReporter) RouterOption {
+	return func(r *Router) {
+		r.panicReporter = f
+	}
+}
+
+func (e *endpoint) reportPanic(ctx context.Context, perr *PanicError) {
+	LoggerFromContext(ctx).LogAttrs(ctx, slog.LevelError, "Panic",
+		slog.String("panic", fmt.Sprint(perr.Value)),
+		slog.String("stack", string(perr.Stack)))
+	if e.panicReporter != nil {
+		e.panicReporter(ctx, perr)
+	}
+}
+
+// publicError returns the error to report to clients in place of err.
+func publicError(err error) error {
+	var perr *PanicError
+	if errors.As(err, &perr) {
+		return errInternal
+	}
+	return err
+}
+
+// sendError sends a Response envelope carrying msg and the request id with
+// the given status.  The envelope is encoded with the negotiated codec if it
+// can represent it, and as JSON otherwise.
+func (e *endpoint) sendError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	codec := e.codecs.responseCodec(r, e.dataType)
+	if _, typed := codec.(TypedCodec); codec == nil || typed {
+		codec = JSONCodec{}
+	}
+
+	b, err := codec.Marshal(Response{
+		Error:     msg,
+		RequestID: RequestIDFromContext(r.Context()),
+	})
+	if err != nil {
+		logError(r.Context(), "Marshal error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", codec.ContentType())
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// serveRecovered calls h, recovering from panics.  If the response has not
+// been started, a 500 is sent.
+func (e *endpoint) serveRecovered(h http.Handler, w *responseRecorder, r *http.Request) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		if v == http.ErrAbortHandler {
+			panic(v)
+		}
+
+		e.reportPanic(r.Context(), newPanicError(v))
+		if !w.written {
+			e.sendError(w, r, http.StatusInternalServerError, errInternal.Error())
+		}
+	}()
+
+	h.ServeHTTP(w, r)
+}
@@ -0,0 +1,91 @@
+package lazy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type PanicTestService struct {
+	TestService
+}
+
+func (s *PanicTestService) Get(ctx context.Context, id int) (*TestData, error) {
+	panic(fmt.Sprintf("get %d", id))
+}
+
+func panicMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("panic") != "" {
+			panic("middleware")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var mu sync.Mutex
+	var reported []*PanicError
+	buf := &syncBuffer{}
+	r := NewRouter(
+		WithLogger(slog.New(slog.NewJSONHandler(buf, nil))),
+		WithPanicReporter(func(ctx context.Context, err *PanicError) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported = append(reported, err)
+		}),
+	)
+	err := r.AddService("test", &PanicTestService{TestService: *NewTestService()},
+		WithMiddleware(panicMiddleware))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	for _, path := range []string{"/test/get/1", "/test/query?panic=1"} {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s%s", addr, path), nil)
+		req.Header.Set(RequestIDHeader, "panic-request")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Get error: %v", err)
+		}
+		var body Response
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Can't decode %s response: %v", path, err)
+		}
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("Expected 500 from %s, got %d", path, resp.StatusCode)
+		}
+		if body.Error != "Internal Server Error" || body.RequestID != "panic-request" {
+			t.Errorf("Unexpected %s response %+v", path, body)
+		}
+	}
+
+	mu.Lock()
+	if len(reported) != 2 || reported[0].Value != "get 1" || reported[1].Value != "middleware" {
+		t.Errorf("Unexpected reported panics %v", reported)
+	}
+	mu.Unlock()
+
+	entries := buf.entries(t)
+	panicEntry := findLogEntry(t, entries, "Panic")
+	if panicEntry["panic"] != "get 1" || panicEntry["request_id"] != "panic-request" ||
+		!strings.Contains(panicEntry["stack"].(string), "PanicTestService") {
+		t.Errorf("Unexpected panic log entry %v", panicEntry)
+	}
+	for _, entry := range entries {
+		if entry["msg"] == "request" && entry["status"] != float64(http.StatusInternalServerError) {
+			t.Errorf("Unexpected access log entry %v", entry)
+		}
+	}
+
+	// The server keeps serving after a panic.
+	testAndValidateNewReq(t, addr, &TestData{ID: 1, Name: "Test 1"})
+}
@@ -0,0 +1,236 @@
+package lazy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// route is a route of a service, relative to its path.
+type route struct {
+	path    string
+	handler http.Handler
+}
+
+// handle adds a route of the service.
+func (e *endpoint) handle(path string, h http.Handler) {
+	e.routes = append(e.routes, route{path, h})
+}
+
+// drain tracks the requests being served by a service, and waits for them
+// once the service is closed.
+type drain struct {
+	mu     sync.Mutex
+	n      int
+	closed bool
+	done   chan struct{}
+}
+
+// enter starts a request.  It returns false if the service is closed, and
+// otherwise must be paired with a call to exit.
+func (d *drain) enter() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return false
+	}
+	d.n++
+	return true
+}
+
+// exit ends a request started by enter.
+func (d *drain) exit() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.n--
+	if d.closed && d.n == 0 {
+		close(d.done)
+	}
+}
+
+// close stops new requests from entering and returns a channel closed once
+// the requests in flight have exited.
+func (d *drain) close() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.closed {
+		d.closed = true
+		d.done = make(chan struct{})
+		if d.n == 0 {
+			close(d.done)
+		}
+	}
+	return d.done
+}
+
+// endpoint returns the service with prefix.
+func (r *Router) endpoint(prefix string) (*endpoint, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.endpoints[prefix]
+	return e, ok
+}
+
+// endpointList returns the services in the order they were added.
+func (r *Router) endpointList() []*endpoint {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*endpoint(nil), r.order...)
+}
+
+// rebuild routes requests to the current services.  Requests being routed
+// with the previous routes finish with them.  r.mu must be held.
+func (r *Router) rebuild() {
+	m := mux.NewRouter()
+	for _, e := range r.order {
+		s := m.PathPrefix(e.path()).Subrouter()
+		for _, rt := range e.routes {
+			s.Handle(rt.path, rt.handler)
+		}
+	}
+
+	var prefixes []string
+	for prefix := range r.versions {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		m.PathPrefix("/" + prefix + "/").Handler(r.versionDispatcher(prefix))
+	}
+
+	r.services.Store(m)
+}
+
+// serveServices routes req to the services of the router.
+func (r *Router) serveServices(w http.ResponseWriter, req *http.Request) {
+	r.services.Load().ServeHTTP(w, req)
+}
+
+// RemoveService removes the service with prefix, and its child services,
+// from the router.  It is safe to call while the router serves requests:
+// new requests for the service fail with 404 Not Found, and RemoveService
+// returns once the requests in flight have finished.  Removed services, and
+// the instances of tenant factories, with a Close() error method are then
+// closed.
+func (r *Router) RemoveService(prefix string) error {
+	r.mu.Lock()
+	e, ok := r.endpoints[prefix]
+	if !ok {
+		r.mu.Unlock()
+		return fmt.Errorf("Service %s not found", prefix)
+	}
+	var removed []*endpoint
+	order := r.order[:0:0]
+	for _, o := range r.order {
+		if !o.below(e) {
+			order = append(order, o)
+			continue
+		}
+		removed = append(removed, o)
+		delete(r.endpoints, o.prefix)
+		if o.version != "" {
+			r.removeVersion(strings.TrimPrefix(o.prefix, o.version+"/"), o)
+		}
+	}
+	r.order = order
+	r.rebuild()
+	r.mu.Unlock()
+
+	r.resetGraphQL()
+	var errs []error
+	for _, o := range removed {
+		errs = append(errs, o.shutdown())
+	}
+	return errors.Join(errs...)
+}
+
+// below reports whether e is the service p or one of its descendants.
+// Parents are compared by prefix, as they may have been replaced since e was
+// added.
+func (e *endpoint) below(p *endpoint) bool {
+	for ; e != nil; e = e.parent {
+		if e.prefix == p.prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplaceService replaces the service with prefix by service, which is
+// added with opts like AddService would, keeping the child services and the
+// version of the replaced service.  It is safe to call while the router
+// serves requests: new requests are served by service, and ReplaceService
+// returns once the requests in flight on the replaced service have
+// finished.  The replaced service is then closed like by RemoveService.
+func (r *Router) ReplaceService(prefix string, service interface{}, opts ...ServiceOption) error {
+	r.mu.Lock()
+	old, ok := r.endpoints[prefix]
+	if !ok {
+		r.mu.Unlock()
+		return fmt.Errorf("Service %s not found", prefix)
+	}
+	relative := prefix
+	switch {
+	case old.parent != nil:
+		relative = strings.TrimPrefix(prefix, old.parent.prefix+"/")
+	case old.version != "":
+		relative = strings.TrimPrefix(prefix, old.version+"/")
+		opts = append(opts, WithVersion(old.version))
+	}
+	e, err := r.newEndpoint(old.parent, relative, service, opts...)
+	if err == nil && e.prefix != prefix {
+		err = fmt.Errorf("Service %s can't replace %s", e.prefix, prefix)
+	}
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	r.endpoints[prefix] = e
+	for i, o := range r.order {
+		if o == old {
+			r.order[i] = e
+		}
+	}
+	r.rebuild()
+	r.mu.Unlock()
+
+	r.resetGraphQL()
+	return old.shutdown()
+}
+
+// shutdown waits for the requests being served by the removed or replaced
+// service to finish and closes it.
+func (e *endpoint) shutdown() error {
+	<-e.requests.close()
+
+	var instances []reflect.Value
+	switch {
+	case e.tenantServices != nil:
+		e.tenantServices.mu.Lock()
+		for _, instance := range e.tenantServices.instances {
+			instances = append(instances, instance)
+		}
+		e.tenantServices.mu.Unlock()
+	case e.service != nil:
+		instances = append(instances, reflect.ValueOf(e.service))
+	}
+
+	var errs []error
+	for _, instance := range instances {
+		closer, ok := instance.Interface().(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e.prefix, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,248 @@
+package lazy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ClosingTestService counts calls of its Close method.
+type ClosingTestService struct {
+	*TestService
+	closed atomic.Int32
+}
+
+func (s *ClosingTestService) Close() error {
+	s.closed.Add(1)
+	return nil
+}
+
+// DrainTestService blocks Get until release is closed.
+type DrainTestService struct {
+	ClosingTestService
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *DrainTestService) Get(ctx context.Context, id int) (*TestData, error) {
+	close(s.entered)
+	<-s.release
+	return s.TestService.Get(ctx, id)
+}
+
+func newNamedTestService(name string) *TestService {
+	s := NewTestService()
+	s.New(context.Background(), &TestData{Name: name})
+	return s
+}
+
+func TestAddServiceDuplicate(t *testing.T) {
+	r := NewRouter()
+	if err := r.AddService("test", NewTestService()); err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	if err := r.AddService("test", NewTestService()); err == nil {
+		t.Errorf("Expected duplicate service to be rejected")
+	}
+	if err := r.AddChildService("test", "child", NewTestService()); err != nil {
+		t.Fatalf("Can't add child service: %v", err)
+	}
+	if err := r.AddChildService("test", "child", NewTestService()); err == nil {
+		t.Errorf("Expected duplicate child service to be rejected")
+	}
+	if err := r.AddService("test", NewTestService(), WithVersion("v1")); err == nil {
+		t.Errorf("Expected version of unversioned service to be rejected")
+	}
+}
+
+func TestRemoveService(t *testing.T) {
+	r := NewRouter()
+	s := &ClosingTestService{TestService: newNamedTestService("One")}
+	if err := r.AddService("test", s); err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	if err := r.AddChildService("test", "child", newNamedTestService("Child")); err != nil {
+		t.Fatalf("Can't add child service: %v", err)
+	}
+	addr := startTestServer(t, r)
+	base := fmt.Sprintf("http://%s/test", addr)
+
+	var data TestData
+	resp := testVersionReq(t, "GET", base+"/get/1", nil, "", &data)
+	if resp.StatusCode != http.StatusOK || data.Name != "One" {
+		t.Fatalf("Expected One, got %d %+v", resp.StatusCode, data)
+	}
+
+	if err := r.RemoveService("test"); err != nil {
+		t.Fatalf("Can't remove service: %v", err)
+	}
+	if n := s.closed.Load(); n != 1 {
+		t.Errorf("Expected removed service to be closed once, got %d", n)
+	}
+	for _, path := range []string{"/get/1", "/1/child/get/1"} {
+		resp := testVersionReq(t, "GET", base+path, nil, "", nil)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s after removal, got %d", path, resp.StatusCode)
+		}
+	}
+	if _, ok := r.endpoint("test/child"); ok {
+		t.Errorf("Expected child service to be removed")
+	}
+	if err := r.RemoveService("test"); err == nil {
+		t.Errorf("Expected removing a missing service to fail")
+	}
+
+	if err := r.AddService("test", newNamedTestService("Two")); err != nil {
+		t.Fatalf("Can't add service again: %v", err)
+	}
+	resp = testVersionReq(t, "GET", base+"/get/1", nil, "", &data)
+	if resp.StatusCode != http.StatusOK || data.Name != "Two" {
+		t.Errorf("Expected Two, got %d %+v", resp.StatusCode, data)
+	}
+}
+
+func TestRemoveServiceKeepsVersions(t *testing.T) {
+	r := NewRouter()
+	if err := r.AddService("v1", newNamedTestService("Service v1")); err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	if err := r.AddService("users", newNamedTestService("Users v1"), WithVersion("v1")); err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+	base := fmt.Sprintf("http://%s", addr)
+
+	// Services whose prefix starts with a removed prefix are not children.
+	if err := r.RemoveService("v1"); err != nil {
+		t.Fatalf("Can't remove service: %v", err)
+	}
+	var data TestData
+	for _, path := range []string{"/users/get/1", "/v1/users/get/1"} {
+		resp := testVersionReq(t, "GET", base+path, nil, "", &data)
+		if resp.StatusCode != http.StatusOK || data.Name != "Users v1" {
+			t.Errorf("Expected versioned service to be kept for %s, got %d %+v", path, resp.StatusCode, data)
+		}
+	}
+
+	// Removing a versioned service forgets its version.
+	if err := r.RemoveService("v1/users"); err != nil {
+		t.Fatalf("Can't remove versioned service: %v", err)
+	}
+	if err := r.AddService("users", newNamedTestService("Users")); err != nil {
+		t.Fatalf("Can't add service without version: %v", err)
+	}
+	resp := testVersionReq(t, "GET", base+"/users/get/1", nil, "", &data)
+	if resp.StatusCode != http.StatusOK || data.Name != "Users" {
+		t.Errorf("Expected unversioned service, got %d %+v", resp.StatusCode, data)
+	}
+}
+
+func TestReplaceService(t *testing.T) {
+	r := NewRouter()
+	old := &ClosingTestService{TestService: newNamedTestService("Old")}
+	if err := r.AddService("test", old); err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	if err := r.AddChildService("test", "child", newNamedTestService("Child")); err != nil {
+		t.Fatalf("Can't add child service: %v", err)
+	}
+	if err := r.AddService("users", newNamedTestService("V1"), WithVersion("v1")); err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+	base := fmt.Sprintf("http://%s", addr)
+
+	if err := r.ReplaceService("test", newNamedTestService("New")); err != nil {
+		t.Fatalf("Can't replace service: %v", err)
+	}
+	if n := old.closed.Load(); n != 1 {
+		t.Errorf("Expected replaced service to be closed once, got %d", n)
+	}
+	var data TestData
+	resp := testVersionReq(t, "GET", base+"/test/get/1", nil, "", &data)
+	if resp.StatusCode != http.StatusOK || data.Name != "New" {
+		t.Errorf("Expected New, got %d %+v", resp.StatusCode, data)
+	}
+	resp = testVersionReq(t, "GET", base+"/test/1/child/get/1", nil, "", &data)
+	if resp.StatusCode != http.StatusOK || data.Name != "Child" {
+		t.Errorf("Expected child service to be kept, got %d %+v", resp.StatusCode, data)
+	}
+
+	if err := r.ReplaceService("v1/users", newNamedTestService("V1 again")); err != nil {
+		t.Fatalf("Can't replace versioned service: %v", err)
+	}
+	resp = testVersionReq(t, "GET", base+"/users/get/1", nil, "", &data)
+	if resp.StatusCode != http.StatusOK || data.Name != "V1 again" || resp.Header.Get(VersionHeader) != "v1" {
+		t.Errorf("Expected replaced version, got %d %+v", resp.StatusCode, data)
+	}
+
+	if err := r.ReplaceService("missing", NewTestService()); err == nil {
+		t.Errorf("Expected replacing a missing service to fail")
+	}
+	if err := r.ReplaceService("test", &TestServiceNoGet{}); err == nil {
+		t.Errorf("Expected replacing with an invalid service to fail")
+	}
+	resp = testVersionReq(t, "GET", base+"/test/get/1", nil, "", &data)
+	if resp.StatusCode != http.StatusOK || data.Name != "New" {
+		t.Errorf("Expected failed replacement to keep the service, got %d %+v", resp.StatusCode, data)
+	}
+}
+
+func TestRemoveServiceDrains(t *testing.T) {
+	r := NewRouter()
+	s := &DrainTestService{
+		ClosingTestService: ClosingTestService{TestService: newNamedTestService("One")},
+		entered:            make(chan struct{}),
+		release:            make(chan struct{}),
+	}
+	if err := r.AddService("test", s); err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+	base := fmt.Sprintf("http://%s/test", addr)
+
+	status := make(chan int)
+	go func() {
+		resp, err := http.Get(base + "/get/1")
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-s.entered
+
+	removed := make(chan error)
+	go func() {
+		removed <- r.RemoveService("test")
+	}()
+	select {
+	case <-removed:
+		t.Fatalf("RemoveService returned with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := s.closed.Load(); n != 0 {
+		t.Errorf("Expected service to stay open with a request in flight, got %d closes", n)
+	}
+
+	// New requests no longer reach the service.
+	resp := testVersionReq(t, "GET", base+"/get/1", nil, "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 while draining, got %d", resp.StatusCode)
+	}
+
+	close(s.release)
+	if code := <-status; code != http.StatusOK {
+		t.Errorf("Expected in-flight request to complete, got %d", code)
+	}
+	if err := <-removed; err != nil {
+		t.Errorf("Can't remove service: %v", err)
+	}
+	if n := s.closed.Load(); n != 1 {
+		t.Errorf("Expected service to be closed once drained, got %d", n)
+	}
+}
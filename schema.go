@@ -0,0 +1,133 @@
+package lazy
+
+import (
+	"encoding"
+	"reflect"
+	"strings"
+)
+
+var typeOfTextMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// Kinds of TypeInfo.
+const (
+	KindObject  = "object"
+	KindArray   = "array"
+	KindString  = "string"
+	KindInteger = "integer"
+	KindNumber  = "number"
+	KindBoolean = "boolean"
+	KindUnknown = "unknown"
+)
+
+// TypeInfo describes the shape of a service's data type as it appears in
+// encoded requests and responses.
+type TypeInfo struct {
+	// Name is the Go type name, e.g. "users.User".
+	Name string `json:"name"`
+
+	// Kind is one of the Kind* constants.
+	Kind string `json:"kind"`
+
+	// Fields lists the fields of objects in declaration order.  Fields of a
+	// type that contains itself are only listed at the outermost level.
+	Fields []FieldInfo `json:"fields,omitempty"`
+
+	// Elem describes the elements of arrays.
+	Elem *TypeInfo `json:"elem,omitempty"`
+}
+
+// FieldInfo describes a field of an object.
+type FieldInfo struct {
+	// Name is the name of the field in encoded data.
+	Name string    `json:"name"`
+	Type *TypeInfo `json:"type"`
+}
+
+type dataField struct {
+	name  string
+	index []int
+	typ   reflect.Type
+	tag   reflect.StructTag
+}
+
+// dataFields lists the exported fields of struct type t, including those
+// promoted from embedded structs, named the way encoding/json names them.
+func dataFields(t reflect.Type) []dataField {
+	var fields []dataField
+	for _, f := range reflect.VisibleFields(t) {
+		if f.Anonymous || !isExported(f.Name) {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			tagName := strings.Split(tag, ",")[0]
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+		fields = append(fields, dataField{name: name, index: f.Index, typ: f.Type, tag: f.Tag})
+	}
+	return fields
+}
+
+func isTextMarshaler(t reflect.Type) bool {
+	return t.Implements(typeOfTextMarshaler) || reflect.PtrTo(t).Implements(typeOfTextMarshaler)
+}
+
+// describeType returns a TypeInfo for t.  seen holds the struct types being
+// described by callers, to stop recursion.
+func describeType(t reflect.Type, seen map[reflect.Type]bool) *TypeInfo {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	info := &TypeInfo{Name: t.String(), Kind: KindUnknown}
+	if isTextMarshaler(t) {
+		info.Kind = KindString
+		return info
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		info.Kind = KindBoolean
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		info.Kind = KindInteger
+	case reflect.Float32, reflect.Float64:
+		info.Kind = KindNumber
+	case reflect.String:
+		info.Kind = KindString
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// Encoded as base64 by encoding/json.
+			info.Kind = KindString
+			break
+		}
+		info.Kind = KindArray
+		info.Elem = describeType(t.Elem(), seen)
+	case reflect.Map:
+		info.Kind = KindObject
+	case reflect.Struct:
+		info.Kind = KindObject
+		if seen[t] {
+			break
+		}
+		seen[t] = true
+		for _, f := range dataFields(t) {
+			info.Fields = append(info.Fields, FieldInfo{
+				Name: f.name,
+				Type: describeType(f.typ, seen),
+			})
+		}
+		delete(seen, t)
+	}
+	return info
+}
+
+// DescribeType returns a TypeInfo describing the Go type t.
+func DescribeType(t reflect.Type) *TypeInfo {
+	return describeType(t, make(map[reflect.Type]bool))
+}
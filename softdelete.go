@@ -0,0 +1,383 @@
+package lazy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Operations of services with soft delete.
+const (
+	OpRestore Operation = "restore"
+	OpPurge   Operation = "purge"
+	OpTrash   Operation = "trash"
+)
+
+// IncludeDeletedParam is the query parameter of Get and Query requests that
+// includes soft deleted records, e.g. "?include_deleted=true".
+const IncludeDeletedParam = "include_deleted"
+
+var typeOfTime = reflect.TypeOf(time.Time{})
+
+var errSoftDeleted = errors.New("record is deleted")
+
+// SoftDeletable is implemented by data types that record their own deletion
+// time for soft delete.  Data types that don't implement it need a DeletedAt
+// field of type time.Time or *time.Time.
+type SoftDeletable interface {
+	// DeletedAt returns when the record was deleted, or the zero time.
+	DeletedAt() time.Time
+
+	// SetDeletedAt marks the record deleted at t, or not deleted if t is
+	// zero.
+	SetDeletedAt(t time.Time)
+}
+
+// WithSoftDelete makes Delete mark records deleted instead of deleting them.
+// Records are marked with the service's Put method, and hidden from Get,
+// Query and expanded relations unless IncludeDeletedParam is set.  Put
+// keeps the deletion time of records, and fails for deleted records.
+//
+// The service gains the routes trash, which lists only the deleted records
+// and takes the same arguments as query, restore/{id}, which unmarks a
+// record, and purge/{id}, which deletes it with the service's Delete method.
+//
+// If retention is positive, Router.Purge deletes records that were soft
+// deleted longer than retention ago.
+func WithSoftDelete(retention time.Duration) ServiceOption {
+	return func(e *endpoint) {
+		e.softDelete = &softDelete{retention: retention}
+	}
+}
+
+// softDelete reads and writes the deletion time of records.
+type softDelete struct {
+	retention time.Duration
+
+	// field is the index of the DeletedAt field, or nil if the data type
+	// implements SoftDeletable.
+	field []int
+}
+
+// findDeletedAt finds how the service's data type records deletion times.
+func (e *endpoint) findDeletedAt() error {
+	if e.softDelete == nil {
+		return nil
+	}
+	if e.dataType.Implements(reflect.TypeOf((*SoftDeletable)(nil)).Elem()) {
+		return nil
+	}
+
+	if e.dataType.Elem().Kind() == reflect.Struct {
+		f, ok := e.dataType.Elem().FieldByName("DeletedAt")
+		if ok && (f.Type == typeOfTime || f.Type == reflect.PtrTo(typeOfTime)) {
+			e.softDelete.field = f.Index
+			return nil
+		}
+	}
+	return fmt.Errorf("Data type %v must implement SoftDeletable or have a DeletedAt time field", e.dataType)
+}
+
+// deletedAt returns when record, a pointer to a record, was deleted.
+func (sd *softDelete) deletedAt(record reflect.Value) time.Time {
+	if sd.field == nil {
+		return record.Interface().(SoftDeletable).DeletedAt()
+	}
+	f := record.Elem().FieldByIndex(sd.field)
+	if f.Kind() == reflect.Ptr {
+		if f.IsNil() {
+			return time.Time{}
+		}
+		f = f.Elem()
+	}
+	return f.Interface().(time.Time)
+}
+
+// setDeletedAt returns a copy of record, a pointer to a record, deleted at
+// t.
+func (sd *softDelete) setDeletedAt(record reflect.Value, t time.Time) reflect.Value {
+	cp := reflect.New(record.Type().Elem())
+	cp.Elem().Set(record.Elem())
+	if sd.field == nil {
+		cp.Interface().(SoftDeletable).SetDeletedAt(t)
+		return cp
+	}
+
+	f := cp.Elem().FieldByIndex(sd.field)
+	switch {
+	case f.Kind() != reflect.Ptr:
+		f.Set(reflect.ValueOf(t))
+	case t.IsZero():
+		f.Set(reflect.Zero(f.Type()))
+	default:
+		f.Set(reflect.ValueOf(&t))
+	}
+	return cp
+}
+
+type includeDeletedKey struct{}
+
+type onlyDeletedKey struct{}
+
+// readContext returns the context for reading records for r, which includes
+// soft deleted records if r asks for them.
+func (e *endpoint) readContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if e.softDelete == nil {
+		return ctx
+	}
+	args := r.URL.Query()
+	if _, ok := args[IncludeDeletedParam]; !ok {
+		return ctx
+	}
+	v := args.Get(IncludeDeletedParam)
+	if include, err := strconv.ParseBool(v); v == "" || (err == nil && include) {
+		return context.WithValue(ctx, includeDeletedKey{}, true)
+	}
+	return ctx
+}
+
+// hidden reports whether record, a pointer to a record, is soft deleted and
+// must be hidden from reads with ctx.
+func (e *endpoint) hidden(ctx context.Context, record reflect.Value) bool {
+	if e.softDelete == nil || record.IsNil() {
+		return false
+	}
+	if include, _ := ctx.Value(includeDeletedKey{}).(bool); include {
+		return false
+	}
+	return !e.softDelete.deletedAt(record).IsZero()
+}
+
+// visible returns the records in results that are not hidden from ctx, or
+// only the deleted records when listing the trash.
+func (e *endpoint) visible(ctx context.Context, results interface{}) interface{} {
+	if e.softDelete == nil {
+		return results
+	}
+	onlyDeleted, _ := ctx.Value(onlyDeletedKey{}).(bool)
+	all := reflect.ValueOf(results)
+	filtered := reflect.MakeSlice(all.Type(), 0, all.Len())
+	for i := 0; i < all.Len(); i++ {
+		record := all.Index(i)
+		keep := !e.hidden(ctx, record)
+		if onlyDeleted {
+			keep = !record.IsNil() && !e.softDelete.deletedAt(record).IsZero()
+		}
+		if keep {
+			filtered = reflect.Append(filtered, record)
+		}
+	}
+	return filtered.Interface()
+}
+
+// doSoftDelete marks a record deleted.  Deleting a deleted record succeeds
+// without changing it.
+func (e *endpoint) doSoftDelete(ctx context.Context, id int) error {
+	ctx, cancel := e.operationContext(ctx, OpDelete)
+	defer cancel()
+
+	data, err := e.getRecord(ctx, id)
+	if err != nil {
+		return err
+	}
+	record := reflect.ValueOf(data)
+	if !e.softDelete.deletedAt(record).IsZero() {
+		return nil
+	}
+	return e.putRecord(ctx, id, e.softDelete.setDeletedAt(record, time.Now()))
+}
+
+// keepDeletedAt returns data, to be put as record id, with the deletion time
+// of the stored record, as records are only deleted and restored with Delete
+// and restore.  Putting a deleted record fails.
+func (e *endpoint) keepDeletedAt(ctx context.Context, id int, data reflect.Value) (reflect.Value, error) {
+	if e.softDelete == nil {
+		return data, nil
+	}
+	current, err := e.getRecord(ctx, id)
+	if isCallFailure(err) {
+		return data, err
+	}
+	record := reflect.ValueOf(current)
+	if err != nil || record.IsNil() {
+		// The service's Put reports missing records.
+		return data, nil
+	}
+	deletedAt := e.softDelete.deletedAt(record)
+	if !deletedAt.IsZero() {
+		return data, fmt.Errorf("ID %d: %w", id, errSoftDeleted)
+	}
+	return e.softDelete.setDeletedAt(data, deletedAt), nil
+}
+
+// doRestore unmarks a deleted record.
+func (e *endpoint) doRestore(ctx context.Context, id int) error {
+	return e.transact(ctx, func(ctx context.Context) error {
+		ctx, cancel := e.operationContext(ctx, OpRestore)
+		defer cancel()
+
+		data, err := e.getRecord(ctx, id)
+		if err != nil {
+			return err
+		}
+		record := reflect.ValueOf(data)
+		if e.softDelete.deletedAt(record).IsZero() {
+			return nil
+		}
+		restored := e.softDelete.setDeletedAt(record, time.Time{})
+		err = e.putRecord(ctx, id, restored)
+		if err == nil {
+			e.audit(ctx, OpRestore, id, data, restored.Interface())
+		}
+		return err
+	})
+}
+
+// doPurge deletes a record with the service's Delete method.
+func (e *endpoint) doPurge(ctx context.Context, id int) error {
+	return e.transact(ctx, func(ctx context.Context) error {
+		before := e.auditBefore(ctx, id)
+		err := e.purgeRecord(ctx, id)
+		if err == nil {
+			e.audit(ctx, OpPurge, id, before, nil)
+		}
+		return err
+	})
+}
+
+// handleRecordOp returns the handler of an operation on the record in the
+// path that returns its id.
+func (e *endpoint) handleRecordOp(method string, do func(ctx context.Context, id int) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		codec := e.responseCodec(w, r)
+		if codec == nil {
+			return
+		}
+
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+
+		err = do(r.Context(), id)
+		if e.handleCallError(r, method, err, w) {
+			return
+		}
+
+		e.sendResponse(w, r, codec, id)
+	}
+}
+
+// handleTrash lists the deleted records that match the query arguments.
+func (e *endpoint) handleTrash(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), onlyDeletedKey{}, true)
+	e.handleQuery(w, r.WithContext(ctx))
+}
+
+// addSoftDeleteRoutes adds the trash, restore and purge routes.
+func (e *endpoint) addSoftDeleteRoutes() {
+	if e.softDelete == nil {
+		return
+	}
+	e.handle("/trash", e.serve(OpTrash, e.handleTrash))
+	e.handle("/restore/{id:[0-9]+}", e.serve(OpRestore, e.handleRecordOp("Restore", e.doRestore)))
+	e.handle("/purge/{id:[0-9]+}", e.serve(OpPurge, e.handleRecordOp("Purge", e.doPurge)))
+}
+
+// purgeExpired deletes the records soft deleted before cutoff.
+func (e *endpoint) purgeExpired(ctx context.Context, cutoff time.Time) error {
+	results, err := e.queryRecords(ctx, url.Values{})
+	if err != nil {
+		return err
+	}
+
+	all := reflect.ValueOf(results)
+	for i := 0; i < all.Len(); i++ {
+		record := all.Index(i)
+		if record.IsNil() {
+			continue
+		}
+		deletedAt := e.softDelete.deletedAt(record)
+		if deletedAt.IsZero() || !deletedAt.Before(cutoff) {
+			continue
+		}
+		id, err := e.recordID(record)
+		if err != nil {
+			return err
+		}
+		err = e.doPurge(ctx, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordID returns the id of record, a pointer to a record, from its ID
+// field.
+func (e *endpoint) recordID(record reflect.Value) (int, error) {
+	if record.Elem().Kind() == reflect.Struct {
+		f := record.Elem().FieldByName("ID")
+		if f.IsValid() && f.Kind() == reflect.Int {
+			return int(f.Int()), nil
+		}
+	}
+	return 0, fmt.Errorf("Data type %v has no int ID field", e.dataType)
+}
+
+// Purge deletes the records of services with soft delete and a retention
+// that were soft deleted longer than the retention ago.  Records are found
+// with the services' Query method with no arguments, which must return all
+// records, and identified by their int ID field.  Child services are not
+// purged.  Services added as tenant factories are purged for every tenant
+// that has used them.
+func (r *Router) Purge(ctx context.Context) error {
+	var errs []error
+	for _, e := range r.endpointList() {
+		if e.softDelete == nil || e.softDelete.retention <= 0 || e.parent != nil {
+			continue
+		}
+		cutoff := time.Now().Add(-e.softDelete.retention)
+		if e.tenantServices == nil {
+			err := e.purgeExpired(ctx, cutoff)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", e.prefix, err))
+			}
+			continue
+		}
+		for _, tenant := range e.tenantServices.list() {
+			err := e.purgeExpired(ContextWithTenant(ctx, tenant), cutoff)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s of %s: %w", e.prefix, tenant, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RunPurger calls Purge every interval until ctx is done.  Errors are
+// logged.
+func (r *Router) RunPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := r.Purge(ctx)
+			if err != nil {
+				r.baseLogger().Error("Purge error", "error", err)
+			}
+		}
+	}
+}
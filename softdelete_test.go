@@ -0,0 +1,235 @@
+package lazy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+)
+
+type SoftTestData struct {
+	ID        int
+	Name      string
+	DeletedAt *time.Time
+}
+
+type SoftTestService struct {
+	nextID int
+	data   map[int]*SoftTestData
+}
+
+func NewSoftTestService() *SoftTestService {
+	return &SoftTestService{nextID: 1, data: make(map[int]*SoftTestData)}
+}
+
+func (s *SoftTestService) Get(ctx context.Context, id int) (*SoftTestData, error) {
+	data, ok := s.data[id]
+	if !ok {
+		return nil, fmt.Errorf("ID %d does not exist", id)
+	}
+	return data, nil
+}
+
+func (s *SoftTestService) Put(ctx context.Context, id int, data *SoftTestData) error {
+	if _, ok := s.data[id]; !ok {
+		return fmt.Errorf("ID %d does not exist", id)
+	}
+	data.ID = id
+	s.data[id] = data
+	return nil
+}
+
+func (s *SoftTestService) New(ctx context.Context, data *SoftTestData) (int, error) {
+	data.ID = s.nextID
+	s.nextID++
+	s.data[data.ID] = data
+	return data.ID, nil
+}
+
+func (s *SoftTestService) Delete(ctx context.Context, id int) error {
+	if _, ok := s.data[id]; !ok {
+		return fmt.Errorf("ID %d does not exist", id)
+	}
+	delete(s.data, id)
+	return nil
+}
+
+func (s *SoftTestService) Query(ctx context.Context, args url.Values) ([]*SoftTestData, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("Unexpected args %v", args)
+	}
+	var results []*SoftTestData
+	for _, d := range s.data {
+		results = append(results, d)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+	return results, nil
+}
+
+type SoftMultiTestService struct {
+	*SoftTestService
+}
+
+func (s *SoftMultiTestService) GetMulti(ctx context.Context, ids []int) ([]*SoftTestData, error) {
+	results := make([]*SoftTestData, len(ids))
+	for i, id := range ids {
+		results[i] = s.data[id]
+	}
+	return results, nil
+}
+
+func testSoftReq(t *testing.T, method string, url string, data interface{}) int {
+	return testActionReq(t, method, url, "", data)
+}
+
+func TestSoftDelete(t *testing.T) {
+	r := NewRouter()
+	s := NewSoftTestService()
+	err := r.AddService("soft", s, WithSoftDelete(0))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	err = r.AddService("bad", NewTestService(), WithSoftDelete(0))
+	if err == nil {
+		t.Errorf("Expected error adding soft delete service without DeletedAt")
+	}
+	addr := startTestServer(t, r)
+	base := fmt.Sprintf("http://%s/soft", addr)
+
+	s.New(context.Background(), &SoftTestData{Name: "One"})
+	s.New(context.Background(), &SoftTestData{Name: "Two"})
+
+	if status := testSoftReq(t, "GET", base+"/delete/1", nil); status != http.StatusOK {
+		t.Fatalf("Expected delete to succeed, got %d", status)
+	}
+	if s.data[1] == nil || s.data[1].DeletedAt == nil {
+		t.Fatalf("Expected record to be marked deleted, got %+v", s.data[1])
+	}
+
+	if status := testSoftReq(t, "GET", base+"/get/1", nil); status != http.StatusNotFound {
+		t.Errorf("Expected deleted record to be hidden, got %d", status)
+	}
+	var data SoftTestData
+	if status := testSoftReq(t, "GET", base+"/get/1?include_deleted", &data); status != http.StatusOK || data.Name != "One" {
+		t.Errorf("Expected deleted record with include_deleted, got %d %+v", status, data)
+	}
+
+	var list []*SoftTestData
+	testSoftReq(t, "GET", base+"/query", &list)
+	if len(list) != 1 || list[0].ID != 2 {
+		t.Errorf("Expected deleted record to be hidden from query, got %v", list)
+	}
+	testSoftReq(t, "GET", base+"/query?include_deleted=true", &list)
+	if len(list) != 2 {
+		t.Errorf("Expected deleted record in query with include_deleted, got %v", list)
+	}
+	for _, path := range []string{"/trash", "/trash?include_deleted"} {
+		list = nil
+		testSoftReq(t, "GET", base+path, &list)
+		if len(list) != 1 || list[0].ID != 1 {
+			t.Errorf("Expected only the deleted record in %s, got %v", path, list)
+		}
+	}
+
+	// Put neither restores deleted records nor changes their deletion time.
+	if status := testActionReq(t, "PUT", base+"/put/1", `{"Name": "Uno"}`, nil); status != http.StatusNotFound {
+		t.Errorf("Expected put of deleted record to fail, got %d", status)
+	}
+	if s.data[1].Name != "One" || s.data[1].DeletedAt == nil {
+		t.Errorf("Expected deleted record to be unchanged, got %+v", s.data[1])
+	}
+	deletedAt := time.Now()
+	if status := testActionReq(t, "PUT", base+"/put/2", fmt.Sprintf(`{"Name": "Dos", "DeletedAt": %q}`, deletedAt.Format(time.RFC3339)), nil); status != http.StatusOK {
+		t.Errorf("Expected put to succeed, got %d", status)
+	}
+	if s.data[2].Name != "Dos" || s.data[2].DeletedAt != nil {
+		t.Errorf("Expected put to keep the record live, got %+v", s.data[2])
+	}
+
+	if status := testSoftReq(t, "GET", base+"/restore/1", nil); status != http.StatusOK {
+		t.Errorf("Expected restore to succeed, got %d", status)
+	}
+	if status := testSoftReq(t, "GET", base+"/get/1", &data); status != http.StatusOK || data.DeletedAt != nil {
+		t.Errorf("Expected restored record, got %d %+v", status, data)
+	}
+
+	if status := testSoftReq(t, "GET", base+"/purge/2", nil); status != http.StatusOK {
+		t.Errorf("Expected purge to succeed, got %d", status)
+	}
+	if _, ok := s.data[2]; ok {
+		t.Errorf("Expected purged record to be gone")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	r := NewRouter()
+	expiring := NewSoftTestService()
+	kept := NewSoftTestService()
+	err := r.AddService("expiring", expiring, WithSoftDelete(time.Hour))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	err = r.AddService("kept", kept, WithSoftDelete(0))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	recent := time.Now()
+	for _, s := range []*SoftTestService{expiring, kept} {
+		s.New(context.Background(), &SoftTestData{Name: "Old", DeletedAt: &old})
+		s.New(context.Background(), &SoftTestData{Name: "Recent", DeletedAt: &recent})
+		s.New(context.Background(), &SoftTestData{Name: "Live"})
+	}
+
+	err = r.Purge(context.Background())
+	if err != nil {
+		t.Fatalf("Purge error: %v", err)
+	}
+	if _, ok := expiring.data[1]; ok || len(expiring.data) != 2 {
+		t.Errorf("Expected only the expired record to be purged, got %v", expiring.data)
+	}
+	if len(kept.data) != 3 {
+		t.Errorf("Expected no records purged without retention, got %v", kept.data)
+	}
+}
+
+func TestSoftDeleteExpand(t *testing.T) {
+	r := NewRouter()
+	users := &SoftMultiTestService{NewSoftTestService()}
+	err := r.AddService("users", users, WithSoftDelete(0))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	posts := &ExpandTestPostService{posts: []*ExpandTestPost{
+		{ID: 1, Title: "First", AuthorID: 1},
+		{ID: 2, Title: "Second", AuthorID: 2},
+	}}
+	err = r.AddService("posts", posts)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	users.New(context.Background(), &SoftTestData{Name: "Ann"})
+	users.New(context.Background(), &SoftTestData{Name: "Bob"})
+	if status := testSoftReq(t, "GET", fmt.Sprintf("http://%s/users/delete/2", addr), nil); status != http.StatusOK {
+		t.Fatalf("Expected delete to succeed, got %d", status)
+	}
+
+	type expandedPost struct {
+		ExpandTestPost
+		Author *SoftTestData `json:"author"`
+	}
+	var list []expandedPost
+	status := testExpandReq(t, addr, "/posts/query?expand=author", &list)
+	if status != http.StatusOK {
+		t.Fatalf("Expected expanded Query to succeed, got %d", status)
+	}
+	if len(list) != 2 || list[0].Author == nil || list[0].Author.Name != "Ann" || list[1].Author != nil {
+		t.Errorf("Expected deleted author to be hidden, got %+v", list)
+	}
+}
@@ -0,0 +1,176 @@
+package lazy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var errNoTenant = errors.New("no tenant")
+
+// TenantResolver extracts the tenant of a request.  It returns "" if req
+// names no tenant, and otherwise the tenant and the request to route, with
+// the tenant removed from its path if it was taken from there.
+type TenantResolver func(req *http.Request) (string, *http.Request)
+
+// TenantHeader resolves tenants from header, e.g. "X-Tenant".
+func TenantHeader(header string) TenantResolver {
+	return func(req *http.Request) (string, *http.Request) {
+		return req.Header.Get(header), req
+	}
+}
+
+// TenantSubdomain resolves tenants from the first label of hosts below
+// domain, e.g. "acme" for "acme.example.com" below "example.com".
+func TenantSubdomain(domain string) TenantResolver {
+	return func(req *http.Request) (string, *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		tenant, ok := strings.CutSuffix(strings.ToLower(host), "."+strings.ToLower(domain))
+		if !ok || strings.Contains(tenant, ".") {
+			return "", req
+		}
+		return tenant, req
+	}
+}
+
+// TenantPathPrefix resolves tenants from the first path segment, e.g.
+// "acme" for "/acme/users/get/1", which is routed as "/users/get/1".
+func TenantPathPrefix() TenantResolver {
+	return func(req *http.Request) (string, *http.Request) {
+		tenant, rest, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+		if tenant == "" {
+			return "", req
+		}
+
+		u := *req.URL
+		u.Path = "/" + rest
+		u.RawPath = ""
+		routed := *req
+		routed.URL = &u
+		return tenant, &routed
+	}
+}
+
+// WithTenants serves every request of the router for the tenant resolve
+// extracts from it, which is put in the request context.  Requests naming no
+// tenant are rejected.  Requests whose context already carries a tenant, e.g.
+// set by authentication middleware in front of the router, are rejected if it
+// differs from the tenant they name.
+//
+// Services added as tenant factories get an instance per tenant.  Cached
+// results, idempotency keys, record history and audit events are kept apart
+// per tenant.
+func WithTenants(resolve TenantResolver) RouterOption {
+	return func(r *Router) {
+		r.tenants = resolve
+	}
+}
+
+type tenantKey struct{}
+
+// ContextWithTenant returns a copy of ctx carrying tenant.
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant in ctx, or "".
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// scopedPrefix qualifies prefix with the tenant in ctx, if any, for keys in
+// stores shared by tenants.
+func scopedPrefix(ctx context.Context, prefix string) string {
+	if tenant := TenantFromContext(ctx); tenant != "" {
+		return tenant + ":" + prefix
+	}
+	return prefix
+}
+
+// validTenant reports whether tenant is a usable tenant name.
+func validTenant(tenant string) bool {
+	if tenant == "" {
+		return false
+	}
+	for _, c := range tenant {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// withTenant wraps h to serve requests for their tenant, if the router has
+// tenants.
+func (r *Router) withTenant(h http.Handler) http.Handler {
+	if r.tenants == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tenant, routed := r.tenants(req)
+		if !validTenant(tenant) {
+			http.Error(w, "Missing or invalid tenant", http.StatusBadRequest)
+			return
+		}
+		if current := TenantFromContext(req.Context()); current != "" && current != tenant {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, routed.WithContext(ContextWithTenant(routed.Context(), tenant)))
+	})
+}
+
+// tenantServices holds the instances of a service added as a tenant factory.
+type tenantServices struct {
+	factory reflect.Value
+
+	mu        sync.Mutex
+	instances map[string]reflect.Value
+}
+
+// isTenantFactory reports whether service is a tenant factory, a function
+// with the signature func(tenant string) (Service, error).
+func isTenantFactory(service interface{}) bool {
+	t := reflect.TypeOf(service)
+	return t != nil && t.Kind() == reflect.Func &&
+		t.NumIn() == 1 && t.In(0).Kind() == reflect.String &&
+		t.NumOut() == 2 && t.Out(1) == typeOfError
+}
+
+// instance returns the service instance of tenant, creating it on first use.
+func (ts *tenantServices) instance(tenant string) (reflect.Value, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if s, ok := ts.instances[tenant]; ok {
+		return s, nil
+	}
+	out := ts.factory.Call([]reflect.Value{reflect.ValueOf(tenant)})
+	if err := callError(out[1]); err != nil {
+		return reflect.Value{}, fmt.Errorf("Can't create service for tenant %s: %w", tenant, err)
+	}
+	ts.instances[tenant] = out[0]
+	return out[0], nil
+}
+
+// list returns the tenants with service instances.
+func (ts *tenantServices) list() []string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var tenants []string
+	for tenant := range ts.instances {
+		tenants = append(tenants, tenant)
+	}
+	return tenants
+}
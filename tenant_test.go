@@ -0,0 +1,115 @@
+package lazy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTenants(t *testing.T) {
+	r := NewRouter(WithTenants(TenantHeader("X-Tenant")))
+	services := make(map[string]*TestService)
+	factory := func(tenant string) (*TestService, error) {
+		if tenant == "broken" {
+			return nil, fmt.Errorf("no database for %s", tenant)
+		}
+		services[tenant] = NewTestService()
+		return services[tenant], nil
+	}
+	err := r.AddService("test", factory, WithCache(CachePolicy{TTL: time.Minute}), WithHistory(nil))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+
+	// Authentication in front of the router binds the request to a tenant.
+	addr := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if bound := req.Header.Get("X-Bound-Tenant"); bound != "" {
+			req = req.WithContext(ContextWithTenant(req.Context(), bound))
+		}
+		r.ServeHTTP(w, req)
+	}))
+	base := fmt.Sprintf("http://%s/test", addr)
+	acme := http.Header{"X-Tenant": {"acme"}}
+	globex := http.Header{"X-Tenant": {"globex"}}
+
+	resp := testVersionReq(t, "POST", base+"/new", acme, `{"Name": "Acme"}`, nil)
+	if resp.StatusCode != http.StatusOK || services["acme"] == nil || services["acme"].data[1].Name != "Acme" {
+		t.Fatalf("Expected record in acme's service, got %d", resp.StatusCode)
+	}
+	var data TestData
+	resp = testVersionReq(t, "GET", base+"/get/1", acme, "", &data)
+	if resp.StatusCode != http.StatusOK || data.Name != "Acme" {
+		t.Errorf("Expected acme's record, got %d %+v", resp.StatusCode, data)
+	}
+
+	// Neither the service nor the cache or history leak records to other
+	// tenants.
+	resp = testVersionReq(t, "GET", base+"/get/1", globex, "", nil)
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("Expected get of other tenant's record to fail")
+	}
+	var versions []RecordVersion
+	testVersionReq(t, "GET", base+"/1/history", globex, "", &versions)
+	if len(versions) != 0 {
+		t.Errorf("Expected no history of other tenant's record, got %v", versions)
+	}
+	if len(services) != 2 {
+		t.Errorf("Expected a service per tenant, got %v", services)
+	}
+
+	for _, test := range []struct {
+		header http.Header
+		status int
+	}{
+		{nil, http.StatusBadRequest},
+		{http.Header{"X-Tenant": {"../acme"}}, http.StatusBadRequest},
+		{http.Header{"X-Tenant": {"acme"}, "X-Bound-Tenant": {"globex"}}, http.StatusForbidden},
+		{http.Header{"X-Tenant": {"acme"}, "X-Bound-Tenant": {"acme"}}, http.StatusOK},
+		{http.Header{"X-Tenant": {"broken"}}, http.StatusInternalServerError},
+	} {
+		resp = testVersionReq(t, "GET", base+"/get/1", test.header, "", nil)
+		if resp.StatusCode != test.status {
+			t.Errorf("Expected %d with %v, got %d", test.status, test.header, resp.StatusCode)
+		}
+	}
+
+	if err := NewRouter().AddService("test", factory); err == nil {
+		t.Errorf("Expected error adding tenant factory to router without tenants")
+	}
+}
+
+func TestTenantResolvers(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://acme.example.com:8080/test/get/1", nil)
+	if tenant, _ := TenantSubdomain("example.com")(req); tenant != "acme" {
+		t.Errorf("Expected subdomain tenant acme, got %q", tenant)
+	}
+	req = httptest.NewRequest("GET", "http://a.b.example.com/test/get/1", nil)
+	if tenant, _ := TenantSubdomain("example.com")(req); tenant != "" {
+		t.Errorf("Expected no tenant for nested subdomain, got %q", tenant)
+	}
+
+	req = httptest.NewRequest("GET", "http://example.com/acme/test/get/1", nil)
+	tenant, routed := TenantPathPrefix()(req)
+	if tenant != "acme" || routed.URL.Path != "/test/get/1" {
+		t.Errorf("Expected path tenant acme routed to /test/get/1, got %q %s", tenant, routed.URL.Path)
+	}
+
+	r := NewRouter(WithTenants(TenantPathPrefix()))
+	err := r.AddService("test", func(tenant string) (*TestService, error) {
+		s := NewTestService()
+		s.New(context.Background(), &TestData{Name: tenant})
+		return s, nil
+	})
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/initech/test/get/1", nil))
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte("initech")) {
+		t.Errorf("Expected initech's record, got %d %s", w.Code, w.Body)
+	}
+}
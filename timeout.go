@@ -0,0 +1,81 @@
+package lazy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TimeoutHeader is the header in which clients may limit the time the server
+// spends on a request.  Its value is a duration such as "1.5s" or "200ms", or
+// an integer number of milliseconds.
+const TimeoutHeader = "X-Request-Timeout"
+
+// DefaultMaxClientTimeout is the longest timeout a client may request in
+// TimeoutHeader unless the router is configured with WithMaxClientTimeout.
+const DefaultMaxClientTimeout = 30 * time.Second
+
+// WithDefaultTimeout limits the time service methods may spend on op for all
+// services of the router.  Services may override it with WithTimeout.
+func WithDefaultTimeout(op Operation, d time.Duration) RouterOption {
+	return func(r *Router) {
+		r.timeouts[op] = d
+	}
+}
+
+// WithMaxClientTimeout caps the timeouts clients may request in
+// TimeoutHeader.  Longer timeouts are reduced to d.  If d is not positive,
+// the header is ignored.
+func WithMaxClientTimeout(d time.Duration) RouterOption {
+	return func(r *Router) {
+		r.maxClientTimeout = d
+	}
+}
+
+// WithTimeout limits the time the service's methods may spend on op.  A
+// non-positive d removes the limit.
+//
+// Cancellation is cooperative: methods are passed a context that is done
+// when the time is up, and should return its error.  Get and Query requests
+// are answered with 504 Gateway Timeout when the time is up even if the
+// method is still running.  New, Put, Delete and action requests wait for
+// the method to return, so that the changes it makes are cached, audited
+// and committed like any other.
+func WithTimeout(op Operation, d time.Duration) ServiceOption {
+	return func(e *endpoint) {
+		e.timeouts[op] = d
+	}
+}
+
+// parseTimeout parses the value of TimeoutHeader.
+func parseTimeout(s string) (time.Duration, bool) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, ms > 0
+	}
+	d, err := time.ParseDuration(s)
+	return d, err == nil && d > 0
+}
+
+// clientTimeoutContext returns a copy of ctx with the deadline requested by
+// the client of req, if any, capped at max.
+func clientTimeoutContext(ctx context.Context, req *http.Request, max time.Duration) (context.Context, context.CancelFunc) {
+	d, ok := parseTimeout(req.Header.Get(TimeoutHeader))
+	if !ok || max <= 0 {
+		return ctx, func() {}
+	}
+	if d > max {
+		d = max
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// operationContext returns a copy of ctx with the deadline of op.  A deadline
+// already in ctx is kept if it is earlier.
+func (e *endpoint) operationContext(ctx context.Context, op Operation) (context.Context, context.CancelFunc) {
+	d := e.timeouts[op]
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
+}
@@ -0,0 +1,184 @@
+package lazy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type SlowTestService struct {
+	TestService
+	Delay time.Duration
+}
+
+// Get ignores ctx.
+func (s *SlowTestService) Get(ctx context.Context, id int) (*TestData, error) {
+	time.Sleep(s.Delay)
+	return &TestData{ID: id}, nil
+}
+
+// Query honors ctx.
+func (s *SlowTestService) Query(ctx context.Context, args url.Values) ([]*TestData, error) {
+	select {
+	case <-time.After(s.Delay):
+		return []*TestData{}, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("query: %w", ctx.Err())
+	}
+}
+
+func testTimeoutReq(t *testing.T, addr string, path string, timeout string) (int, time.Duration) {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s%s", addr, path), nil)
+	if timeout != "" {
+		req.Header.Set(TimeoutHeader, timeout)
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	defer resp.Body.Close()
+	elapsed := time.Since(start)
+
+	if resp.StatusCode == http.StatusGatewayTimeout {
+		var body Response
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		if err != nil {
+			t.Fatalf("Can't decode %s response: %v", path, err)
+		}
+		if body.Error != "Gateway Timeout" || body.RequestID == "" {
+			t.Errorf("Unexpected %s response %+v", path, body)
+		}
+	}
+	return resp.StatusCode, elapsed
+}
+
+func TestTimeouts(t *testing.T) {
+	r := NewRouter(
+		WithDefaultTimeout(OpGet, 50*time.Millisecond),
+		WithDefaultTimeout(OpQuery, 50*time.Millisecond),
+		WithMaxClientTimeout(100*time.Millisecond),
+	)
+	err := r.AddService("slow", &SlowTestService{TestService: *NewTestService(), Delay: time.Second})
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	err = r.AddService("fast", &SlowTestService{TestService: *NewTestService(), Delay: 10 * time.Millisecond},
+		WithTimeout(OpGet, 0))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	err = r.AddService("patient", &SlowTestService{TestService: *NewTestService(), Delay: 200 * time.Millisecond},
+		WithTimeout(OpQuery, time.Second))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	for _, test := range []struct {
+		path    string
+		timeout string
+		status  int
+	}{
+		// Router defaults apply to services that ignore ctx and those
+		// that honor it.
+		{"/slow/get/1", "", http.StatusGatewayTimeout},
+		{"/slow/query", "", http.StatusGatewayTimeout},
+		{"/fast/get/1", "", http.StatusOK},
+		{"/fast/query", "", http.StatusOK},
+
+		// Service timeouts override router defaults.
+		{"/patient/query", "", http.StatusOK},
+
+		// Client timeouts shorten deadlines, but not below the cap.
+		{"/fast/get/1", "1", http.StatusGatewayTimeout},
+		{"/fast/get/1", "1ms", http.StatusGatewayTimeout},
+		{"/patient/query", "20ms", http.StatusGatewayTimeout},
+		{"/fast/get/1", "bogus", http.StatusOK},
+	} {
+		status, _ := testTimeoutReq(t, addr, test.path, test.timeout)
+		if status != test.status {
+			t.Errorf("Expected %d from %s with timeout %q, got %d", test.status, test.path, test.timeout, status)
+		}
+	}
+
+	// A stuck method does not hold the request past the deadline.
+	_, elapsed := testTimeoutReq(t, addr, "/slow/get/1", "")
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("Expected timed out request to return promptly, took %v", elapsed)
+	}
+
+	// Client timeouts are capped.
+	status, _ := testTimeoutReq(t, addr, "/patient/query", "10s")
+	if status != http.StatusGatewayTimeout {
+		t.Errorf("Expected capped client timeout to expire, got %d", status)
+	}
+}
+
+// SlowPutTestService has a Put that ignores ctx.
+type SlowPutTestService struct {
+	*TestService
+	Delay time.Duration
+}
+
+func (s *SlowPutTestService) Put(ctx context.Context, id int, data *TestData) error {
+	time.Sleep(s.Delay)
+	return s.TestService.Put(ctx, id, data)
+}
+
+func TestTimeoutWaitsForChanges(t *testing.T) {
+	r := NewRouter()
+	sink := NewMemoryAuditSink()
+	s := &SlowPutTestService{TestService: newNamedTestService("Old"), Delay: 50 * time.Millisecond}
+	err := r.AddService("test", s, WithTimeout(OpPut, 10*time.Millisecond),
+		WithCache(CachePolicy{TTL: time.Hour}), WithAudit(sink), WithHistory(nil))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+	base := fmt.Sprintf("http://%s/test", addr)
+
+	var data TestData
+	testVersionReq(t, "GET", base+"/get/1", nil, "", &data)
+	resp := testVersionReq(t, "PUT", base+"/put/1", nil, `{"Name": "New"}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected Put outlasting its timeout to be waited for, got %d", resp.StatusCode)
+	}
+
+	// The change is not hidden from the cache, audit log and history.
+	testVersionReq(t, "GET", base+"/get/1", nil, "", &data)
+	if data.Name != "New" {
+		t.Errorf("Expected cached record to be invalidated, got %+v", data)
+	}
+	events, _ := sink.Query(context.Background(), AuditFilter{Prefix: "test"})
+	if len(events) != 1 || events[0].Operation != OpPut {
+		t.Errorf("Expected Put to be audited, got %+v", events)
+	}
+	var versions []RecordVersion
+	testVersionReq(t, "GET", base+"/1/history", nil, "", &versions)
+	if len(versions) != 1 {
+		t.Errorf("Expected Put to be stored in the history, got %+v", versions)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"250":   250 * time.Millisecond,
+		"1.5s":  1500 * time.Millisecond,
+		"200ms": 200 * time.Millisecond,
+	} {
+		d, ok := parseTimeout(s)
+		if !ok || d != expected {
+			t.Errorf("Expected %q to parse as %v, got %v", s, expected, d)
+		}
+	}
+	for _, s := range []string{"", "0", "-5", "-1s", "soon"} {
+		if _, ok := parseTimeout(s); ok {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package lazy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceFlagSampled is the W3C trace context flag marking a trace as sampled.
+const TraceFlagSampled = 0x01
+
+// SpanContext identifies a span within a trace, as carried by the W3C
+// traceparent header.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// IsValid reports whether sc has non-zero trace and span ids.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent formats sc as a traceparent header value.
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-%02x",
+		hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), sc.Flags)
+}
+
+// ParseTraceParent parses a traceparent header value.
+func ParseTraceParent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 ||
+		len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("Malformed traceparent %q", s)
+	}
+	// Version ff is invalid and version 00 has exactly four fields.
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("Unsupported traceparent version in %q", s)
+	}
+
+	var flags [1]byte
+	_, err1 := hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	_, err2 := hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	_, err3 := hex.Decode(flags[:], []byte(parts[3]))
+	if err1 != nil || err2 != nil || err3 != nil || !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("Invalid traceparent %q", s)
+	}
+	sc.Flags = flags[0]
+	return sc, nil
+}
+
+// Span is a traced operation.
+type Span interface {
+	Context() SpanContext
+	SetAttribute(key string, value interface{})
+
+	// SetError marks the span as failed with err.
+	SetError(err error)
+
+	End()
+}
+
+// Tracer starts spans.  The parent of a new span is the span in ctx, or the
+// remote span context in ctx if it has no span.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+type spanKey struct{}
+type remoteSpanContextKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying span.
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span in ctx, or nil.
+func SpanFromContext(ctx context.Context) Span {
+	span, _ := ctx.Value(spanKey{}).(Span)
+	return span
+}
+
+// ContextWithRemoteSpanContext returns a copy of ctx carrying sc, the context
+// of a span in another process.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteSpanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the context of the span in ctx, falling back
+// to a remote span context.  The result is invalid if ctx has neither.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.Context()
+	}
+	sc, _ := ctx.Value(remoteSpanContextKey{}).(SpanContext)
+	return sc
+}
+
+type nopSpan struct{}
+
+func (nopSpan) Context() SpanContext                       { return SpanContext{} }
+func (nopSpan) SetAttribute(key string, value interface{}) {}
+func (nopSpan) SetError(err error)                         {}
+func (nopSpan) End()                                       {}
+
+// nopTracer is used by routers without a tracer.
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+// SpanData is a finished span.
+type SpanData struct {
+	Name       string
+	Context    SpanContext
+	Parent     SpanContext
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Err        error
+}
+
+// SpanExporter receives spans as they end.
+type SpanExporter interface {
+	ExportSpan(span SpanData)
+}
+
+// InMemoryExporter keeps finished spans in memory.  It is intended for tests.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+// ExportSpan implements the SpanExporter interface.
+func (e *InMemoryExporter) ExportSpan(span SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns the spans exported so far in the order they ended.
+func (e *InMemoryExporter) Spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]SpanData(nil), e.spans...)
+}
+
+// Reset discards all exported spans.
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.spans = nil
+}
+
+type span struct {
+	mu       sync.Mutex
+	data     SpanData
+	exporter SpanExporter
+	ended    bool
+}
+
+func (s *span) Context() SpanContext {
+	return s.data.Context
+}
+
+func (s *span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Attributes[key] = value
+}
+
+func (s *span) SetError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Err = err
+}
+
+func (s *span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	s.exporter.ExportSpan(data)
+}
+
+type tracer struct {
+	exporter SpanExporter
+}
+
+// NewTracer returns a Tracer that samples every span and sends finished spans
+// to exporter.
+func NewTracer(exporter SpanExporter) Tracer {
+	return &tracer{exporter: exporter}
+}
+
+func (t *tracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent := SpanContextFromContext(ctx)
+
+	sc := SpanContext{Flags: TraceFlagSampled}
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.Flags = parent.Flags
+	} else {
+		rand.Read(sc.TraceID[:])
+	}
+	rand.Read(sc.SpanID[:])
+
+	s := &span{
+		data: SpanData{
+			Name:       name,
+			Context:    sc,
+			Parent:     parent,
+			Start:      time.Now(),
+			Attributes: make(map[string]interface{}),
+		},
+		exporter: t.exporter,
+	}
+	return ContextWithSpan(ctx, s), s
+}
+
+// WithTracer traces every service operation with t.  Incoming traceparent
+// headers are honored and the span of each service method call is in the
+// context passed to the service.
+func WithTracer(t Tracer) RouterOption {
+	return func(r *Router) {
+		r.tracer = t
+	}
+}
@@ -0,0 +1,122 @@
+package lazy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+type TracingTestService struct {
+	TestService
+	LastSpanContext SpanContext
+}
+
+func (s *TracingTestService) Get(ctx context.Context, id int) (*TestData, error) {
+	s.LastSpanContext = SpanContextFromContext(ctx)
+	return s.TestService.Get(ctx, id)
+}
+
+func findSpan(t *testing.T, spans []SpanData, name string) SpanData {
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("No %s span in %v", name, spans)
+	return SpanData{}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := &InMemoryExporter{}
+	r := NewRouter(WithTracer(NewTracer(exporter)))
+	s := &TracingTestService{TestService: *NewTestService()}
+	err := r.AddService("test", s)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	testAndValidateNewReq(t, addr, &TestData{ID: 1, Name: "Test 1"})
+	spans := exporter.Spans()
+	if len(spans) != 4 {
+		t.Fatalf("Expected 4 spans from New, got %v", spans)
+	}
+	root := findSpan(t, spans, "test.new")
+	if root.Parent.IsValid() {
+		t.Errorf("Expected root span without parent, got %v", root.Parent)
+	}
+	if root.Attributes["http.status_code"] != http.StatusOK {
+		t.Errorf("Unexpected status attribute %v", root.Attributes["http.status_code"])
+	}
+	for _, name := range []string{"decode", "call", "encode"} {
+		span := findSpan(t, spans, name)
+		if span.Parent != root.Context {
+			t.Errorf("Expected %s span to be a child of the root span", name)
+		}
+	}
+	if findSpan(t, spans, "call").Attributes["lazy.method"] != "New" {
+		t.Errorf("Expected call span of New")
+	}
+	exporter.Reset()
+
+	// An incoming traceparent is honored.
+	parent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/test/get/2", addr), nil)
+	req.Header.Set("traceparent", parent)
+	_, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+
+	spans = exporter.Spans()
+	root = findSpan(t, spans, "test.get")
+	if root.Parent.TraceParent() != parent {
+		t.Errorf("Expected parent %s, got %s", parent, root.Parent.TraceParent())
+	}
+	if root.Context.TraceID != root.Parent.TraceID {
+		t.Errorf("Expected span to join the incoming trace")
+	}
+	if root.Err == nil {
+		t.Errorf("Expected failed Get to mark the root span as failed")
+	}
+	call := findSpan(t, spans, "call")
+	if call.Err == nil {
+		t.Errorf("Expected call span to record the service error")
+	}
+	if s.LastSpanContext != call.Context {
+		t.Errorf("Expected service context to carry the call span")
+	}
+}
+
+func TestParseTraceParent(t *testing.T) {
+	valid := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	sc, err := ParseTraceParent(valid)
+	if err != nil {
+		t.Fatalf("Can't parse %s: %v", valid, err)
+	}
+	if sc.Flags != TraceFlagSampled || sc.TraceParent() != valid {
+		t.Errorf("Unexpected span context %v", sc)
+	}
+
+	// Future versions may append fields.
+	_, err = ParseTraceParent("01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra")
+	if err != nil {
+		t.Errorf("Unexpected error parsing future version: %v", err)
+	}
+
+	for _, s := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319g-b7ad6b7169203331-01",
+	} {
+		_, err = ParseTraceParent(s)
+		if err == nil {
+			t.Errorf("Expected error parsing %q", s)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package lazy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Tx is a transaction begun by a Transactor.
+type Tx interface {
+	Commit() error
+	Rollback() error
+}
+
+// Transactor begins the transactions lazy runs mutations in.
+type Transactor interface {
+	Begin(ctx context.Context) (Tx, error)
+}
+
+// WithTransactor runs every mutating operation of the service, New, Put,
+// Delete, restore, purge, revert and actions, in a transaction begun with t.
+// The transaction is committed if the service methods succeed and rolled
+// back otherwise.  It is in the context passed to the service methods, see
+// TxFromContext, so that they can make other changes in it.  Operations that
+// run in a transaction already, e.g. a Put calling another service, join it.
+//
+// Audit events and record versions are stored once the transaction has
+// been committed, and results read in a transaction are not cached.
+func WithTransactor(t Transactor) ServiceOption {
+	return func(e *endpoint) {
+		e.transactor = t
+	}
+}
+
+// WithBatchTransactor runs each JSON-RPC batch in a single transaction begun
+// with t.  If any call of the batch fails, the transaction is rolled back and
+// every call of the batch reports an error.
+func WithBatchTransactor(t Transactor) RouterOption {
+	return func(r *Router) {
+		r.batchTransactor = t
+	}
+}
+
+// txState is a transaction in progress and the work to do once it has been
+// committed.
+type txState struct {
+	tx Tx
+
+	mu       sync.Mutex
+	onCommit []func()
+}
+
+type txKey struct{}
+
+// TxFromContext returns the transaction ctx runs in, or nil.  The
+// transactions of an SQLTransactor are *sql.Tx.
+func TxFromContext(ctx context.Context) Tx {
+	if state, ok := ctx.Value(txKey{}).(*txState); ok {
+		return state.tx
+	}
+	return nil
+}
+
+// afterCommit runs f once the transaction of ctx has been committed, or now
+// if ctx runs in no transaction.  f is dropped if the transaction is rolled
+// back.
+func afterCommit(ctx context.Context, f func()) {
+	state, ok := ctx.Value(txKey{}).(*txState)
+	if !ok {
+		f()
+		return
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.onCommit = append(state.onCommit, f)
+}
+
+// inTransaction runs fn in a transaction begun with t, or in the transaction
+// of ctx if it has one.  The transaction is committed if fn succeeds and
+// rolled back otherwise.
+func inTransaction(ctx context.Context, t Transactor, fn func(ctx context.Context) error) error {
+	if t == nil || TxFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+
+	tx, err := t.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	state := &txState{tx: tx}
+	err = fn(context.WithValue(ctx, txKey{}, state))
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			logError(ctx, "Rollback error", rerr)
+		}
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	for _, f := range state.onCommit {
+		f()
+	}
+	return nil
+}
+
+// transact runs fn in a transaction of the service's transactor.
+func (e *endpoint) transact(ctx context.Context, fn func(ctx context.Context) error) error {
+	return inTransaction(ctx, e.transactor, fn)
+}
+
+// SQLTransactor begins transactions on a database/sql database.
+type SQLTransactor struct {
+	DB *sql.DB
+
+	// Options are passed to BeginTx, and may be nil.
+	Options *sql.TxOptions
+}
+
+// Begin implements the Transactor interface.
+func (t *SQLTransactor) Begin(ctx context.Context) (Tx, error) {
+	return t.DB.BeginTx(ctx, t.Options)
+}
+
+// SQLTxFromContext returns the database/sql transaction ctx runs in, if
+// any.
+func SQLTxFromContext(ctx context.Context) (*sql.Tx, bool) {
+	tx, ok := TxFromContext(ctx).(*sql.Tx)
+	return tx, ok
+}
+
+var errTxDone = errors.New("transaction already committed or rolled back")
+
+// MemoryTransactor is a Transactor for tests and in-memory services.  Its
+// transactions undo changes registered with OnRollback when rolled back.
+type MemoryTransactor struct {
+	commits   atomic.Int64
+	rollbacks atomic.Int64
+}
+
+// MemoryTx is a transaction of a MemoryTransactor.
+type MemoryTx struct {
+	t *MemoryTransactor
+
+	mu   sync.Mutex
+	undo []func()
+	done bool
+}
+
+// Begin implements the Transactor interface.
+func (t *MemoryTransactor) Begin(ctx context.Context) (Tx, error) {
+	return &MemoryTx{t: t}, nil
+}
+
+// Commits returns the number of transactions committed.
+func (t *MemoryTransactor) Commits() int {
+	return int(t.commits.Load())
+}
+
+// Rollbacks returns the number of transactions rolled back.
+func (t *MemoryTransactor) Rollbacks() int {
+	return int(t.rollbacks.Load())
+}
+
+// MemoryTxFromContext returns the MemoryTx ctx runs in, if any.
+func MemoryTxFromContext(ctx context.Context) (*MemoryTx, bool) {
+	tx, ok := TxFromContext(ctx).(*MemoryTx)
+	return tx, ok
+}
+
+// OnRollback registers undo to be called if the transaction is rolled back.
+// Undo functions are called in reverse order.
+func (tx *MemoryTx) OnRollback(undo func()) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.undo = append(tx.undo, undo)
+}
+
+// Commit implements the Tx interface.
+func (tx *MemoryTx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return errTxDone
+	}
+	tx.done = true
+	tx.undo = nil
+	tx.t.commits.Add(1)
+	return nil
+}
+
+// Rollback implements the Tx interface.
+func (tx *MemoryTx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return errTxDone
+	}
+	tx.done = true
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = nil
+	tx.t.rollbacks.Add(1)
+	return nil
+}
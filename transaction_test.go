@@ -0,0 +1,174 @@
+package lazy
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TxTestService undoes its changes when their transaction is rolled back.
+type TxTestService struct {
+	*TestService
+	FailPut bool
+}
+
+func (s *TxTestService) Put(ctx context.Context, id int, data *TestData) error {
+	tx, ok := MemoryTxFromContext(ctx)
+	if !ok {
+		return fmt.Errorf("Put outside a transaction")
+	}
+	old, ok := s.data[id]
+	if !ok {
+		return fmt.Errorf("ID %d does not exist", id)
+	}
+	s.data[id] = data
+	tx.OnRollback(func() { s.data[id] = old })
+
+	// The change is made before the failure, as hooks might.
+	if s.FailPut {
+		return fmt.Errorf("Put Failure")
+	}
+	return nil
+}
+
+func (s *TxTestService) New(ctx context.Context, data *TestData) (int, error) {
+	id, err := s.TestService.New(ctx, data)
+	if tx, ok := MemoryTxFromContext(ctx); ok && err == nil {
+		tx.OnRollback(func() {
+			delete(s.data, id)
+			s.nextID = id
+		})
+	}
+	return id, err
+}
+
+func TestTransactor(t *testing.T) {
+	r := NewRouter()
+	transactor := &MemoryTransactor{}
+	s := &TxTestService{TestService: NewTestService()}
+	sink := NewMemoryAuditSink()
+	err := r.AddService("test", s, WithTransactor(transactor), WithAudit(sink))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+	base := fmt.Sprintf("http://%s/test", addr)
+
+	testVersionReq(t, "POST", base+"/new", nil, `{"Name": "One"}`, nil)
+	resp := testVersionReq(t, "PUT", base+"/put/1", nil, `{"Name": "Two"}`, nil)
+	if resp.StatusCode != http.StatusOK || s.data[1].Name != "Two" {
+		t.Fatalf("Expected put to succeed, got %d", resp.StatusCode)
+	}
+	if transactor.Commits() != 2 || transactor.Rollbacks() != 0 {
+		t.Errorf("Expected 2 commits, got %d commits and %d rollbacks",
+			transactor.Commits(), transactor.Rollbacks())
+	}
+
+	s.FailPut = true
+	resp = testVersionReq(t, "PUT", base+"/put/1", nil, `{"Name": "Three"}`, nil)
+	if resp.StatusCode == http.StatusOK || s.data[1].Name != "Two" {
+		t.Errorf("Expected failed put to be rolled back, got %d %+v", resp.StatusCode, s.data[1])
+	}
+	if transactor.Rollbacks() != 1 {
+		t.Errorf("Expected a rollback, got %d", transactor.Rollbacks())
+	}
+	events, _ := sink.Query(context.Background(), AuditFilter{})
+	if len(events) != 2 {
+		t.Errorf("Expected only committed changes to be audited, got %+v", events)
+	}
+}
+
+func TestBatchTransactor(t *testing.T) {
+	transactor := &MemoryTransactor{}
+	r := NewRouter(WithBatchTransactor(transactor))
+	s := &TxTestService{TestService: NewTestService()}
+	err := r.AddService("test", s)
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	m := mux.NewRouter()
+	m.Handle("/rpc", r.JSONRPCHandler())
+	addr := startTestServer(t, m)
+
+	status, b := testRPCReq(t, addr, `[
+		{"jsonrpc": "2.0", "method": "test.new", "params": [{"Name": "One"}], "id": 1},
+		{"jsonrpc": "2.0", "method": "test.put", "params": [7, {"Name": "Missing"}], "id": 2}
+	]`)
+	var responses []testRPCResponse
+	if err := json.Unmarshal(b, &responses); err != nil || status != http.StatusOK || len(responses) != 2 {
+		t.Fatalf("Unexpected batch response %d %s", status, b)
+	}
+	if responses[0].Error == nil || responses[1].Error == nil {
+		t.Errorf("Expected every call of a failed batch to fail, got %s", b)
+	}
+	if len(s.data) != 0 || transactor.Rollbacks() != 1 {
+		t.Errorf("Expected batch to be rolled back, got %v", s.data)
+	}
+
+	testRPCReq(t, addr, `[
+		{"jsonrpc": "2.0", "method": "test.new", "params": [{"Name": "One"}], "id": 1},
+		{"jsonrpc": "2.0", "method": "test.put", "params": [1, {"Name": "Two"}], "id": 2}
+	]`)
+	if len(s.data) != 1 || s.data[1].Name != "Two" || transactor.Commits() != 1 {
+		t.Errorf("Expected batch to be committed, got %v", s.data)
+	}
+}
+
+// testSQLDriver is a database/sql driver whose connections only count
+// transactions.
+type testSQLDriver struct {
+	commits, rollbacks int
+}
+
+type testSQLConn struct{ d *testSQLDriver }
+type testSQLTx struct{ d *testSQLDriver }
+
+func (d *testSQLDriver) Open(name string) (driver.Conn, error) { return &testSQLConn{d}, nil }
+func (c *testSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c *testSQLConn) Close() error              { return nil }
+func (c *testSQLConn) Begin() (driver.Tx, error) { return &testSQLTx{c.d}, nil }
+func (tx *testSQLTx) Commit() error              { tx.d.commits++; return nil }
+func (tx *testSQLTx) Rollback() error            { tx.d.rollbacks++; return nil }
+
+// SQLTestService requires a database/sql transaction.
+type SQLTestService struct {
+	*TestService
+}
+
+func (s *SQLTestService) New(ctx context.Context, data *TestData) (int, error) {
+	if _, ok := SQLTxFromContext(ctx); !ok {
+		return 0, fmt.Errorf("New outside a transaction")
+	}
+	return s.TestService.New(ctx, data)
+}
+
+func TestSQLTransactor(t *testing.T) {
+	d := &testSQLDriver{}
+	sql.Register("lazytest", d)
+	db, err := sql.Open("lazytest", "")
+	if err != nil {
+		t.Fatalf("Can't open database: %v", err)
+	}
+	defer db.Close()
+
+	r := NewRouter()
+	err = r.AddService("test", &SQLTestService{NewTestService()}, WithTransactor(&SQLTransactor{DB: db}))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	resp := testVersionReq(t, "POST", fmt.Sprintf("http://%s/test/new", addr), nil, `{"Name": "One"}`, nil)
+	if resp.StatusCode != http.StatusOK || d.commits != 1 {
+		t.Errorf("Expected New to commit an SQL transaction, got %d with %d commits", resp.StatusCode, d.commits)
+	}
+}
@@ -0,0 +1,211 @@
+package lazy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// callMethods are the HTTP methods of the REST routes of the operations.
+var callMethods = map[Operation]string{
+	OpGet:    http.MethodGet,
+	OpPut:    http.MethodPut,
+	OpNew:    http.MethodPost,
+	OpDelete: http.MethodDelete,
+	OpQuery:  http.MethodGet,
+}
+
+// pendingCall is an operation requested over JSON-RPC or GraphQL, on its way
+// through the handler of its operation.
+type pendingCall struct {
+	fn func(ctx context.Context) (interface{}, error)
+
+	done   bool
+	result interface{}
+	err    error
+}
+
+type pendingCallKey struct{}
+
+type transportRequestKey struct{}
+
+type callNameKey struct{}
+
+// contextWithTransportRequest returns a copy of ctx carrying req, the
+// JSON-RPC or GraphQL request whose operations are served with ctx.
+func contextWithTransportRequest(ctx context.Context, req *http.Request) context.Context {
+	return context.WithValue(ctx, transportRequestKey{}, req)
+}
+
+// contextWithCallName returns a copy of ctx naming the operation served with
+// it among those of its JSON-RPC batch or GraphQL document, e.g. by its
+// position in the batch.
+func contextWithCallName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, callNameKey{}, name)
+}
+
+// isCall reports whether r is the request of an operation requested over
+// JSON-RPC or GraphQL.
+func isCall(r *http.Request) bool {
+	_, ok := r.Context().Value(pendingCallKey{}).(*pendingCall)
+	return ok
+}
+
+// callStatus returns the status of the REST response to an operation
+// failing with err.
+func callStatus(err error) int {
+	switch {
+	case errors.Is(err, errSoftDeleted) || errors.Is(err, errNoVersion):
+		return http.StatusNotFound
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// addCallHandlers adds the handlers of the operations requested over
+// JSON-RPC and GraphQL.  They go through the same limits, middleware and
+// instrumentation as the REST routes.
+func (e *endpoint) addCallHandlers() {
+	e.calls = make(map[Operation]http.Handler)
+	for op := range callMethods {
+		e.calls[op] = e.instrument(op, http.HandlerFunc(e.serveCall))
+	}
+}
+
+// serveCall runs the pending call of r.  Results of New, Put and Delete are
+// written, so that the idempotency store can replay them.
+func (e *endpoint) serveCall(w http.ResponseWriter, r *http.Request) {
+	c := r.Context().Value(pendingCallKey{}).(*pendingCall)
+	result, err := c.fn(r.Context())
+	c.done, c.result, c.err = true, result, err
+	if err != nil {
+		w.WriteHeader(callStatus(err))
+		return
+	}
+	if r.Method != http.MethodGet {
+		b, err := json.Marshal(result)
+		if err != nil {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// callWriter keeps the response to an operation requested over JSON-RPC or
+// GraphQL.
+type callWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *callWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *callWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *callWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// callRejectedError reports an operation refused by the service's limits or
+// middleware.
+type callRejectedError struct {
+	status int
+	msg    string
+}
+
+func (err *callRejectedError) Error() string {
+	return err.msg
+}
+
+// operate performs operation op requested over JSON-RPC or GraphQL by
+// calling fn.  fn runs as the handler of the REST route of op on record id,
+// with the query args and body, so that the service's limits, middleware and
+// idempotency keys apply to it as they do to REST requests.  The request
+// carries the headers of the JSON-RPC or GraphQL request, with the name of
+// the call appended to its idempotency key, so that the operations of a
+// batch or document are not replays of each other.
+func (e *endpoint) operate(ctx context.Context, op Operation, id int, args url.Values, body interface{},
+	fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	var b []byte
+	if body != nil {
+		var err error
+		b, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	u := &url.URL{Path: e.path() + "/" + string(op), RawQuery: args.Encode()}
+	vars := map[string]string{}
+	if op != OpNew && op != OpQuery {
+		vars["id"] = strconv.Itoa(id)
+		u.Path += "/" + vars["id"]
+	}
+
+	c := &pendingCall{fn: fn}
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, pendingCallKey{}, c),
+		callMethods[op], u.String(), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if outer, ok := ctx.Value(transportRequestKey{}).(*http.Request); ok {
+		req.Header = outer.Header.Clone()
+		req.Host = outer.Host
+		req.RemoteAddr = outer.RemoteAddr
+		req.TLS = outer.TLS
+	}
+	if key := req.Header.Get(IdempotencyKeyHeader); key != "" {
+		if name, ok := ctx.Value(callNameKey{}).(string); ok {
+			req.Header.Set(IdempotencyKeyHeader, key+"/"+name)
+		}
+	}
+	if id := RequestIDFromContext(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Del("Content-Type")
+	}
+	req = mux.SetURLVars(req, vars)
+
+	w := &callWriter{header: http.Header{}, status: http.StatusOK}
+	e.calls[op].ServeHTTP(w, req)
+	if c.done {
+		return c.result, c.err
+	}
+
+	// fn didn't run: the response was replayed from the idempotency store,
+	// or the limits or middleware rejected the request.
+	if w.status < http.StatusBadRequest && w.header.Get(IdempotentReplayedHeader) == "true" {
+		// Results of New, Put and Delete are ids.
+		var id int
+		err := json.Unmarshal(w.body.Bytes(), &id)
+		return id, err
+	}
+	if w.status < http.StatusBadRequest || w.status >= http.StatusInternalServerError {
+		return nil, errInternal
+	}
+	msg := http.StatusText(w.status)
+	var resp Response
+	if json.Unmarshal(w.body.Bytes(), &resp) == nil && resp.Error != "" {
+		msg = resp.Error
+	} else if text := string(bytes.TrimSpace(w.body.Bytes())); text != "" && !json.Valid(w.body.Bytes()) {
+		msg = text
+	}
+	return nil, &callRejectedError{status: w.status, msg: msg}
+}
@@ -0,0 +1,170 @@
+package lazy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func testTransportReq(t *testing.T, method string, url string, header http.Header, body string) (int, string) {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header = header.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	var b bytes.Buffer
+	b.ReadFrom(resp.Body)
+	return resp.StatusCode, b.String()
+}
+
+func TestMiddlewareAllTransports(t *testing.T) {
+	r := NewRouter()
+	s := newNamedTestService("Secret")
+	deny := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("X-User") != "admin" {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, req)
+		})
+	}
+	if err := r.AddService("test", s, WithMiddleware(deny)); err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", r.JSONRPCHandler())
+	mux.Handle("/graphql", r.GraphQLHandler())
+	mux.Handle("/", r)
+	addr := startTestServer(t, mux)
+
+	rest := fmt.Sprintf("http://%s/test/get/1", addr)
+	rpc := fmt.Sprintf("http://%s/rpc", addr)
+	gql := fmt.Sprintf("http://%s/graphql", addr)
+	rpcGet := `{"jsonrpc": "2.0", "method": "test.get", "params": [1], "id": 1}`
+	rpcDelete := `{"jsonrpc": "2.0", "method": "test.delete", "params": [1], "id": 2}`
+	gqlGet, _ := json.Marshal(map[string]string{"query": `{ test_get(id: 1) { Name } }`})
+	gqlDelete, _ := json.Marshal(map[string]string{"query": `mutation { test_delete(id: 1) }`})
+
+	for _, header := range []http.Header{{}, {"X-User": {"nobody"}}} {
+		if status, body := testTransportReq(t, "GET", rest, header, ""); status != http.StatusForbidden {
+			t.Errorf("Expected REST to be denied, got %d %s", status, body)
+		}
+		for _, body := range []string{rpcGet, rpcDelete} {
+			_, resp := testTransportReq(t, "POST", rpc, header, body)
+			if !strings.Contains(resp, `"error":{"code":-32000,"message":"Forbidden"}`) || strings.Contains(resp, "Secret") {
+				t.Errorf("Expected JSON-RPC %s to be denied, got %s", body, resp)
+			}
+		}
+		for _, body := range [][]byte{gqlGet, gqlDelete} {
+			_, resp := testTransportReq(t, "POST", gql, header, string(body))
+			if !strings.Contains(resp, `"message":"Forbidden"`) || strings.Contains(resp, "Secret") {
+				t.Errorf("Expected GraphQL %s to be denied, got %s", body, resp)
+			}
+		}
+	}
+	if _, ok := s.data[1]; !ok {
+		t.Fatalf("Denied delete removed the record")
+	}
+
+	admin := http.Header{"X-User": {"admin"}}
+	if status, body := testTransportReq(t, "GET", rest, admin, ""); status != http.StatusOK || !strings.Contains(body, "Secret") {
+		t.Errorf("Expected REST to be allowed, got %d %s", status, body)
+	}
+	if _, resp := testTransportReq(t, "POST", rpc, admin, rpcGet); !strings.Contains(resp, `"result":{"ID":1,"Name":"Secret"}`) {
+		t.Errorf("Expected JSON-RPC to be allowed, got %s", resp)
+	}
+	if _, resp := testTransportReq(t, "POST", gql, admin, string(gqlGet)); resp != `{"data":{"test_get":{"Name":"Secret"}}}` {
+		t.Errorf("Expected GraphQL to be allowed, got %s", resp)
+	}
+}
+
+func TestLimitsAllTransports(t *testing.T) {
+	r := NewRouter()
+	s := NewTestService()
+	err := r.AddService("test", s, WithIdempotency(nil), WithRateLimit(0, 3, nil))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", r.JSONRPCHandler())
+	addr := startTestServer(t, mux)
+	rpc := fmt.Sprintf("http://%s/rpc", addr)
+
+	// Retries of a call with the same idempotency key are replayed.
+	key := http.Header{IdempotencyKeyHeader: {"key-1"}}
+	body := `{"jsonrpc": "2.0", "method": "test.new", "params": [{"Name": "One"}], "id": 1}`
+	for i := 0; i < 2; i++ {
+		if _, resp := testTransportReq(t, "POST", rpc, key, body); resp != `{"jsonrpc":"2.0","result":1,"id":1}` {
+			t.Errorf("Expected id 1 from call %d, got %s", i, resp)
+		}
+	}
+	if len(s.data) != 1 {
+		t.Errorf("Expected 1 record, got %d", len(s.data))
+	}
+
+	// The rate limit counts calls like REST requests.
+	get := `{"jsonrpc": "2.0", "method": "test.get", "params": [1], "id": 1}`
+	if _, resp := testTransportReq(t, "POST", rpc, http.Header{}, get); !strings.Contains(resp, `"result"`) {
+		t.Errorf("Expected call within the limit to succeed, got %s", resp)
+	}
+	if _, resp := testTransportReq(t, "POST", rpc, http.Header{}, get); !strings.Contains(resp, "Too Many Requests") {
+		t.Errorf("Expected call over the limit to be rejected, got %s", resp)
+	}
+
+	r.metrics.mu.Lock()
+	defer r.metrics.mu.Unlock()
+	if om := r.metrics.ops[metricsKey{"test", OpNew, http.StatusOK}]; om == nil || om.requests != 2 {
+		t.Errorf("Expected 2 new calls in metrics, got %+v", om)
+	}
+}
+
+func TestIdempotencyKeyPerCall(t *testing.T) {
+	r := NewRouter()
+	s := NewTestService()
+	err := r.AddService("test", s, WithIdempotency(nil))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", r.JSONRPCHandler())
+	mux.Handle("/graphql", r.GraphQLHandler())
+	addr := startTestServer(t, mux)
+	rpc := fmt.Sprintf("http://%s/rpc", addr)
+	gql := fmt.Sprintf("http://%s/graphql", addr)
+
+	// Each call of a batch creates a record, and retries of the batch are
+	// replayed.
+	key := http.Header{IdempotencyKeyHeader: {"batch-1"}}
+	batch := `[{"jsonrpc": "2.0", "method": "test.new", "params": [{"Name": "One"}], "id": 1},
+		{"jsonrpc": "2.0", "method": "test.new", "params": [{"Name": "Two"}], "id": 2}]`
+	expected := `[{"jsonrpc":"2.0","result":1,"id":1},{"jsonrpc":"2.0","result":2,"id":2}]`
+	for i := 0; i < 2; i++ {
+		if _, resp := testTransportReq(t, "POST", rpc, key, batch); resp != expected {
+			t.Errorf("Expected ids 1 and 2 from batch %d, got %s", i, resp)
+		}
+	}
+	if len(s.data) != 2 {
+		t.Errorf("Expected 2 records, got %d", len(s.data))
+	}
+
+	// Likewise for the mutations of a GraphQL document.
+	key = http.Header{IdempotencyKeyHeader: {"doc-1"}}
+	doc, _ := json.Marshal(map[string]string{
+		"query": `mutation { a: test_new(data: {Name: "Three"}) b: test_new(data: {Name: "Four"}) }`,
+	})
+	for i := 0; i < 2; i++ {
+		if _, resp := testTransportReq(t, "POST", gql, key, string(doc)); resp != `{"data":{"a":3,"b":4}}` {
+			t.Errorf("Expected ids 3 and 4 from document %d, got %s", i, resp)
+		}
+	}
+	if len(s.data) != 4 {
+		t.Errorf("Expected 4 records, got %d", len(s.data))
+	}
+}
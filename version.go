@@ -0,0 +1,242 @@
+package lazy
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// VersionHeader is the default header in which clients may select the
+// version of a service.  The version served is echoed in it.
+const VersionHeader = "API-Version"
+
+// WithVersion adds the service as version of its prefix, e.g. "v1".  Each
+// version of a prefix is a separate service served below /<version>/<prefix>
+// and has "<version>/<prefix>" as its prefix elsewhere, e.g. in JSON-RPC
+// method names.
+//
+// Requests to /<prefix> are routed to the version named in the router's
+// version header, or in a "version" parameter of the Accept header, e.g.
+// "application/json; version=v2".  Requests naming no version are routed to
+// the first version added.
+func WithVersion(version string) ServiceOption {
+	return func(e *endpoint) {
+		e.version = version
+	}
+}
+
+// WithVersionHeader sets the header in which clients select service
+// versions.  The default is VersionHeader.
+func WithVersionHeader(header string) RouterOption {
+	return func(r *Router) {
+		r.versionHeader = header
+	}
+}
+
+// Deprecation announces that a service version will go away.
+type Deprecation struct {
+	// Date is when the version was or will be deprecated.
+	Date time.Time
+
+	// Sunset is when the version will stop being served.  It is not sent
+	// if zero.
+	Sunset time.Time
+
+	// Link is the URL of documentation about the deprecation, e.g. a
+	// migration guide.  It is not sent if empty.
+	Link string
+}
+
+// WithDeprecation sends Deprecation (RFC 9745) and Sunset (RFC 8594) headers
+// with every response of the service.
+func WithDeprecation(d Deprecation) ServiceOption {
+	return func(e *endpoint) {
+		e.deprecation = &d
+	}
+}
+
+// setDeprecationHeaders sets the deprecation headers of the service, if it
+// is deprecated.
+func (e *endpoint) setDeprecationHeaders(w http.ResponseWriter) {
+	d := e.deprecation
+	if d == nil {
+		return
+	}
+	w.Header().Set("Deprecation", fmt.Sprintf("@%d", d.Date.Unix()))
+	if !d.Sunset.IsZero() {
+		w.Header().Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if d.Link != "" {
+		w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="deprecation"`, d.Link))
+	}
+}
+
+// requestVersion returns the version req asks for, or "".
+func (r *Router) requestVersion(req *http.Request) string {
+	if v := req.Header.Get(r.versionHeader); v != "" {
+		return v
+	}
+	for _, part := range strings.Split(req.Header.Get("Accept"), ",") {
+		_, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && params["version"] != "" {
+			return params["version"]
+		}
+	}
+	return ""
+}
+
+// addVersion records the version of the service e.  r.mu must be held.
+func (r *Router) addVersion(prefix string, e *endpoint) {
+	r.versions[prefix] = append(r.versions[prefix], e.version)
+}
+
+// removeVersion forgets the version of the service e.  r.mu must be held.
+func (r *Router) removeVersion(prefix string, e *endpoint) {
+	var versions []string
+	for _, v := range r.versions[prefix] {
+		if v != e.version {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) == 0 {
+		delete(r.versions, prefix)
+		return
+	}
+	r.versions[prefix] = versions
+}
+
+// defaultVersion returns the version of prefix serving requests without a
+// version, the first one added, or "".
+func (r *Router) defaultVersion(prefix string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if versions := r.versions[prefix]; len(versions) > 0 {
+		return versions[0]
+	}
+	return ""
+}
+
+// versionDispatcher routes requests without a version in their path to the
+// version of prefix they ask for.
+func (r *Router) versionDispatcher(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fallback := r.defaultVersion(prefix)
+		version := r.requestVersion(req)
+		if version == "" {
+			version = fallback
+		}
+		e, ok := r.endpoint(version + "/" + prefix)
+		if !ok {
+			msg := fmt.Sprintf("Version %s of %s not found", version, prefix)
+			if e, ok := r.endpoint(fallback + "/" + prefix); ok {
+				e.sendError(w, req, http.StatusNotFound, msg)
+			} else {
+				http.Error(w, msg, http.StatusNotFound)
+			}
+			return
+		}
+
+		u := *req.URL
+		u.Path = "/" + e.prefix + strings.TrimPrefix(u.Path, "/"+prefix)
+		u.RawPath = ""
+		versioned := *req
+		versioned.URL = &u
+		r.serveServices(w, &versioned)
+	})
+}
+
+// convertedService serves a version of a service whose records are of type
+// Old from the endpoint of another version whose records are of type New.
+// The endpoint is looked up on each call, so that it may be replaced.
+type convertedService[Old, New any] struct {
+	router *Router
+	target string
+	down   func(*New) *Old
+	up     func(*Old) *New
+}
+
+// endpoint returns the current endpoint of the target version.
+func (s *convertedService[Old, New]) endpoint() (*endpoint, error) {
+	e, ok := s.router.endpoint(s.target)
+	if !ok {
+		return nil, fmt.Errorf("Service %s not found", s.target)
+	}
+	if e.dataType != reflect.TypeOf((*New)(nil)) {
+		return nil, fmt.Errorf("Service %s stores %v, not %v", s.target, e.dataType, reflect.TypeOf((*New)(nil)))
+	}
+	return e, nil
+}
+
+func (s *convertedService[Old, New]) Get(ctx context.Context, id int) (*Old, error) {
+	e, err := s.endpoint()
+	if err != nil {
+		return nil, err
+	}
+	data, err := e.doGet(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.down(data.(*New)), nil
+}
+
+func (s *convertedService[Old, New]) Put(ctx context.Context, id int, data *Old) error {
+	e, err := s.endpoint()
+	if err != nil {
+		return err
+	}
+	return e.doPut(ctx, id, reflect.ValueOf(s.up(data)))
+}
+
+func (s *convertedService[Old, New]) New(ctx context.Context, data *Old) (int, error) {
+	e, err := s.endpoint()
+	if err != nil {
+		return 0, err
+	}
+	return e.doNew(ctx, reflect.ValueOf(s.up(data)))
+}
+
+func (s *convertedService[Old, New]) Delete(ctx context.Context, id int) error {
+	e, err := s.endpoint()
+	if err != nil {
+		return err
+	}
+	return e.doDelete(ctx, id)
+}
+
+func (s *convertedService[Old, New]) Query(ctx context.Context, args url.Values) ([]*Old, error) {
+	e, err := s.endpoint()
+	if err != nil {
+		return nil, err
+	}
+	results, err := e.doQuery(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	var converted []*Old
+	for _, data := range results.([]*New) {
+		converted = append(converted, s.down(data))
+	}
+	return converted, nil
+}
+
+// AddConvertedVersion adds version of prefix, served by the service already
+// added as version target of prefix.  Records are converted from the target's
+// type New with down, and to it with up.
+func AddConvertedVersion[Old, New any](r *Router, prefix string, version string, target string,
+	down func(*New) *Old, up func(*Old) *New, opts ...ServiceOption) error {
+	e, ok := r.endpoint(target + "/" + prefix)
+	if !ok {
+		return fmt.Errorf("Version %s of %s not found", target, prefix)
+	}
+	if e.dataType != reflect.TypeOf((*New)(nil)) {
+		return fmt.Errorf("Version %s of %s stores %v, not %v", target, prefix, e.dataType, reflect.TypeOf((*New)(nil)))
+	}
+
+	service := &convertedService[Old, New]{router: r, target: e.prefix, down: down, up: up}
+	return r.AddService(prefix, service, append(opts, WithVersion(version))...)
+}
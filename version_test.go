@@ -0,0 +1,122 @@
+package lazy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type V1TestData struct {
+	ID    int
+	Title string
+}
+
+func testVersionReq(t *testing.T, method string, url string, header http.Header, body string, data interface{}) *http.Response {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s error: %v", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && data != nil {
+		ret := Response{Data: data}
+		err = json.NewDecoder(resp.Body).Decode(&ret)
+		if err != nil {
+			t.Fatalf("Can't decode %s response: %v", url, err)
+		}
+	}
+	return resp
+}
+
+func TestVersions(t *testing.T) {
+	r := NewRouter(WithVersionHeader("X-Version"))
+	s := NewTestService()
+	err := r.AddService("test", s, WithVersion("v2"))
+	if err != nil {
+		t.Fatalf("Can't add service: %v", err)
+	}
+	sunset := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = AddConvertedVersion(r, "test", "v1", "v2",
+		func(d *TestData) *V1TestData { return &V1TestData{ID: d.ID, Title: strings.ToUpper(d.Name)} },
+		func(d *V1TestData) *TestData { return &TestData{Name: strings.ToLower(d.Title)} },
+		WithDeprecation(Deprecation{Date: time.Unix(1000, 0), Sunset: sunset, Link: "https://example.com/v2"}))
+	if err != nil {
+		t.Fatalf("Can't add converted version: %v", err)
+	}
+	addr := startTestServer(t, r)
+
+	// Old clients write through the converter.
+	resp := testVersionReq(t, "POST", fmt.Sprintf("http://%s/v1/test/new", addr), nil, `{"Title": "FIRST"}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected v1 New to succeed, got %d", resp.StatusCode)
+	}
+	if s.data[1] == nil || s.data[1].Name != "first" {
+		t.Errorf("Expected converted record in v2 service, got %+v", s.data[1])
+	}
+	if resp.Header.Get("Deprecation") != "@1000" ||
+		resp.Header.Get("Sunset") != "Tue, 01 Jan 2030 00:00:00 GMT" ||
+		resp.Header.Get("Link") != `<https://example.com/v2>; rel="deprecation"` {
+		t.Errorf("Unexpected deprecation headers %v", resp.Header)
+	}
+
+	var v1 V1TestData
+	resp = testVersionReq(t, "GET", fmt.Sprintf("http://%s/v1/test/get/1", addr), nil, "", &v1)
+	if v1.Title != "FIRST" || resp.Header.Get("X-Version") != "v1" {
+		t.Errorf("Unexpected v1 record %+v from version %s", v1, resp.Header.Get("X-Version"))
+	}
+	var v1List []*V1TestData
+	testVersionReq(t, "GET", fmt.Sprintf("http://%s/v1/test/query", addr), nil, "", &v1List)
+	if len(v1List) != 1 || v1List[0].Title != "FIRST" {
+		t.Errorf("Unexpected v1 query results %v", v1List)
+	}
+
+	var v2 TestData
+	resp = testVersionReq(t, "GET", fmt.Sprintf("http://%s/v2/test/get/1", addr), nil, "", &v2)
+	if v2.Name != "first" || resp.Header.Get("Deprecation") != "" {
+		t.Errorf("Unexpected v2 record %+v with headers %v", v2, resp.Header)
+	}
+
+	// Unversioned paths are routed by header, defaulting to the first
+	// version added.
+	for _, test := range []struct {
+		header  http.Header
+		version string
+	}{
+		{nil, "v2"},
+		{http.Header{"X-Version": {"v1"}}, "v1"},
+		{http.Header{"Accept": {"application/json; version=v1"}}, "v1"},
+	} {
+		resp = testVersionReq(t, "GET", fmt.Sprintf("http://%s/test/get/1", addr), test.header, "", nil)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Version") != test.version {
+			t.Errorf("Expected version %s with %v, got %d from %s",
+				test.version, test.header, resp.StatusCode, resp.Header.Get("X-Version"))
+		}
+	}
+	resp = testVersionReq(t, "GET", fmt.Sprintf("http://%s/test/get/1", addr),
+		http.Header{"X-Version": {"v9"}}, "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown version, got %d", resp.StatusCode)
+	}
+
+	if err := r.AddService("test", NewTestService()); err == nil {
+		t.Errorf("Expected error adding unversioned service with versions")
+	}
+	if err := AddConvertedVersion(r, "test", "v0", "v1",
+		func(d *TestData) *V1TestData { return nil },
+		func(d *V1TestData) *TestData { return nil }); err == nil {
+		t.Errorf("Expected error converting from mismatched type")
+	}
+
+	services := r.Services()
+	if len(services) != 2 || services[0].Prefix != "v1/test" || !services[0].Deprecated ||
+		services[1].Version != "v2" {
+		t.Errorf("Unexpected services %+v", services)
+	}
+}